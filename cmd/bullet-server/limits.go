@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Protection against guessing share codes. Each IP gets a bucket of
+// lookupBurst failed share code lookups that refills one every
+// lookupRefill, and is banned for banDuration once it runs dry.
+// Fan-out share codes, which receivers can keep trying, are also
+// invalidated after maxWrongPeers receivers had a different one.
+var (
+	lookupBurst   int // 0 disables banning
+	lookupRefill  time.Duration
+	banDuration   time.Duration
+	maxWrongPeers int // 0 for no limit
+)
+
+type lookupBucket struct {
+	tokens      float64
+	updated     time.Time
+	bannedUntil time.Time
+}
+
+// Buckets of IPs that failed lookups recently, forgotten
+// by forgetRecoveredIPs once they're full again
+var lookupBuckets = make(map[string]*lookupBucket)
+var lookupBucketsMu sync.Mutex
+
+func (b *lookupBucket) refill(now time.Time) {
+	if lookupRefill > 0 {
+		b.tokens = min(b.tokens+float64(now.Sub(b.updated))/float64(lookupRefill), float64(lookupBurst))
+	}
+	b.updated = now
+}
+
+// Returns how much longer ip is banned for, 0 if it isn't
+func bannedFor(ip string, now time.Time) time.Duration {
+	lookupBucketsMu.Lock()
+	defer lookupBucketsMu.Unlock()
+	b, exists := lookupBuckets[ip]
+	if !exists {
+		return 0
+	}
+	return max(b.bannedUntil.Sub(now), 0)
+}
+
+// Records a failed share code lookup by ip, banning it if its bucket has run dry
+func lookupFailed(ip string, now time.Time) {
+	failedLookups.Add(1)
+	if lookupBurst <= 0 {
+		return
+	}
+	lookupBucketsMu.Lock()
+	defer lookupBucketsMu.Unlock()
+	b, exists := lookupBuckets[ip]
+	if !exists {
+		b = &lookupBucket{tokens: float64(lookupBurst), updated: now}
+		lookupBuckets[ip] = b
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return
+	}
+	log.Printf("Banning %s for %s after too many failed share code lookups\n", ip, banDuration)
+	bans.Add(1)
+	b.bannedUntil = now.Add(banDuration)
+	b.tokens = float64(lookupBurst) // starts over once the ban is lifted
+}
+
+// Forgets IPs that are no longer banned and whose bucket has refilled
+func forgetRecoveredIPs(now time.Time) {
+	lookupBucketsMu.Lock()
+	defer lookupBucketsMu.Unlock()
+	for ip, b := range lookupBuckets {
+		b.refill(now)
+		if now.After(b.bannedUntil) && b.tokens >= float64(lookupBurst) {
+			delete(lookupBuckets, ip)
+		}
+	}
+}
+
+func clientIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/diwasrimal/bullet/pkg/proto"
+)
+
+// Sets a global for the duration of the test
+func setGlobal[T any](t *testing.T, global *T, value T) {
+	old := *global
+	*global = value
+	t.Cleanup(func() { *global = old })
+}
+
+func TestLookupBan(t *testing.T) {
+	setGlobal(t, &lookupBurst, 3)
+	setGlobal(t, &lookupRefill, time.Minute)
+	setGlobal(t, &banDuration, 10*time.Minute)
+	setGlobal(t, &lookupBuckets, make(map[string]*lookupBucket))
+	const ip, other = "192.0.2.1", "192.0.2.2"
+	now := time.Now()
+
+	for i := range lookupBurst {
+		lookupFailed(ip, now)
+		if d := bannedFor(ip, now); d != 0 {
+			t.Fatalf("banned for %s after %d failed lookups, burst is %d", d, i+1, lookupBurst)
+		}
+	}
+	lookupFailed(ip, now)
+	if d := bannedFor(ip, now); d != banDuration {
+		t.Fatalf("banned for %s once the bucket ran dry, want %s", d, banDuration)
+	}
+	if d := bannedFor(other, now); d != 0 {
+		t.Errorf("other IP is banned for %s", d)
+	}
+
+	// Bucket starts over full once the ban is lifted
+	now = now.Add(banDuration)
+	if d := bannedFor(ip, now); d != 0 {
+		t.Fatalf("still banned for %s after the ban", d)
+	}
+	for range lookupBurst {
+		lookupFailed(ip, now)
+	}
+	if d := bannedFor(ip, now); d != 0 {
+		t.Fatalf("banned for %s again within the burst", d)
+	}
+
+	// One lookup comes back every lookupRefill
+	now = now.Add(lookupRefill)
+	lookupFailed(ip, now)
+	if d := bannedFor(ip, now); d != 0 {
+		t.Fatalf("banned for %s despite a refilled lookup", d)
+	}
+	lookupFailed(ip, now)
+	if d := bannedFor(ip, now); d != banDuration {
+		t.Fatalf("banned for %s after using up the refill, want %s", d, banDuration)
+	}
+
+	forgetRecoveredIPs(now.Add(banDuration - time.Second))
+	if _, exists := lookupBuckets[ip]; !exists {
+		t.Error("banned IP was forgotten")
+	}
+	forgetRecoveredIPs(now.Add(banDuration + time.Duration(lookupBurst)*lookupRefill))
+	if len(lookupBuckets) != 0 {
+		t.Errorf("%d recovered IPs weren't forgotten", len(lookupBuckets))
+	}
+}
+
+func TestLookupBanDisabled(t *testing.T) {
+	setGlobal(t, &lookupBurst, 0)
+	setGlobal(t, &lookupBuckets, make(map[string]*lookupBucket))
+	now := time.Now()
+	for range 100 {
+		lookupFailed("192.0.2.1", now)
+	}
+	if d := bannedFor("192.0.2.1", now); d != 0 {
+		t.Errorf("banned for %s with banning disabled", d)
+	}
+}
+
+func TestInvalidateGuessedCode(t *testing.T) {
+	setGlobal(t, &maxWrongPeers, 2)
+	client, conn := net.Pipe()
+	defer client.Close()
+	s := sender{
+		conn:      conn,
+		channel:   "test-invalidate",
+		evicted:   make(chan proto.ErrorPayload, 1),
+		receivers: -1,
+		joined:    make(chan string),
+		left:      make(chan struct{}),
+	}
+	sendersMu.Lock()
+	senders[s.channel] = s
+	sendersMu.Unlock()
+	t.Cleanup(func() {
+		sendersMu.Lock()
+		delete(senders, s.channel)
+		sendersMu.Unlock()
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveFanout(context.Background(), s, -1)
+	}()
+
+	for range maxWrongPeers {
+		_, err := proto.WriteFrame(client, proto.OpcodeWrongPeer, proto.JSONToBytes(proto.WrongPeerPayload{
+			ID: "someone",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := proto.ReadExpectedFrame(client, proto.OpcodeReceiverJoined)
+	var relayErr *proto.ErrorPayload
+	if !errors.As(err, &relayErr) || relayErr.Code != proto.ErrShareCodeInvalidated {
+		t.Fatalf("sender was told %v, want share code invalidated", err)
+	}
+	sendersMu.Lock()
+	_, exists := senders[s.channel]
+	sendersMu.Unlock()
+	if exists {
+		t.Error("invalidated share code is still registered")
+	}
+	client.Close()
+	<-done
+}
+
+type brokenWriter struct{}
+
+func (brokenWriter) Write(p []byte) (int, error) {
+	return 0, net.ErrClosed
+}
+
+func TestForwardKeyExchange(t *testing.T) {
+	frames := func(opcodes ...proto.Opcode) *bytes.Buffer {
+		var buf bytes.Buffer
+		for _, opcode := range opcodes {
+			proto.WriteFrame(&buf, opcode, []byte("payload"))
+		}
+		return &buf
+	}
+	exchange := []proto.Opcode{proto.OpcodeKeyExchange, proto.OpcodeKeyConfirm}
+
+	// Receiver with the same share code gets all of it, the rest is left
+	var dst bytes.Buffer
+	src := frames(append(exchange, proto.OpcodeEncryptedChunk, proto.OpcodeEncryptedChunk)...)
+	n, reported, err := forwardKeyExchange(&dst, src)
+	if err != nil || reported {
+		t.Fatalf("forwardKeyExchange() = %v, %v, want no report or error", reported, err)
+	}
+	if want := frames(append(exchange, proto.OpcodeEncryptedChunk)...); !bytes.Equal(dst.Bytes(), want.Bytes()) || n != int64(want.Len()) {
+		t.Errorf("forwarded %d bytes %q, want %q", n, dst.Bytes(), want.Bytes())
+	}
+	if src.Len() != frames(proto.OpcodeEncryptedChunk).Len() {
+		t.Errorf("%d bytes left of the sender's stream, want one more chunk", src.Len())
+	}
+
+	// Report is meant for us, even if receiver has gone away
+	for _, dst := range []io.Writer{&bytes.Buffer{}, brokenWriter{}} {
+		_, reported, err = forwardKeyExchange(dst, frames(append(exchange, proto.OpcodeWrongPeer)...))
+		if err != nil || !reported {
+			t.Errorf("forwardKeyExchange() = %v, %v, want the report", reported, err)
+		}
+	}
+
+	// Sender hanging up early isn't an error
+	_, reported, err = forwardKeyExchange(&bytes.Buffer{}, frames(proto.OpcodeKeyExchange))
+	if err != nil || reported {
+		t.Errorf("forwardKeyExchange() = %v, %v, want no report or error", reported, err)
+	}
+}
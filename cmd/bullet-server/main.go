@@ -1,14 +1,29 @@
 package main
 
 import (
+	"context"
+	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/diwasrimal/bullet/pkg/proto"
+	"github.com/diwasrimal/bullet/pkg/ratelimit"
 	"github.com/diwasrimal/bullet/pkg/utils"
 )
 
@@ -31,56 +46,277 @@ import (
 // var senders = make(map[string]Client)
 // var sendersMu sync.Mutex
 
+// The relay never learns file details, or even the full share code, only
+// the channel part of it which is used to pair sender with a receiver.
 type sender struct {
 	conn                net.Conn
 	waitTillConsumption chan struct{} // to block senders from closing until someone consumes the file
-	shareCode           string        // string code used for identifying file
-	filename            string
-	filesize            int64
+	channel             string        // public part of the share code used for pairing
+	capabilities        []string      // negotiated during handshake, told to receiver when pairing
+	access              access        // what sender's API token allows
+	size                int64         // bytes sender is about to send, 0 if not known
+	createdAt           time.Time
+	ttl                 time.Duration           // share code is reaped if no receiver shows up by then
+	evicted             chan proto.ErrorPayload // why sender was removed before anyone consumed the file
+
+	// Fan-out senders serve each receiver on a new connection, they're
+	// told about waiting receivers through joined. Nil for other senders.
+	receivers int           // how many more receivers can be paired, negative for no limit
+	joined    chan string   // IDs of receivers waiting to be served
+	left      chan struct{} // closed once sender's registering connection is gone
 }
 
+// A receiver waiting for a fan-out sender to connect again and serve it
+type join struct {
+	channel string
+	served  chan servingSender // buffered, gets the sender's new connection
+}
+
+// Connection a fan-out sender serves a receiver on
+type servingSender struct {
+	conn         net.Conn
+	capabilities []string
+	access       access
+	done         chan struct{} // closed once the transfer is over
+}
+
+// Capabilities relay supports, clients only get to use ones in this list
+var serverCapabilities = proto.Capabilities
+
 // Map of senders trying to send a file
-// mapping is done with their file share codes
-// TODO: occasionally cleanup stale connections
+// mapping is done with their share code channels,
+// stale ones are removed by reapExpiredSenders
 var senders = make(map[string]sender)
 var sendersMu sync.Mutex
 
+// Set once shutdown has evicted senders, no more can register after that.
+// Guarded by sendersMu.
+var shuttingDown bool
+
+// Receivers waiting on fan-out senders, mapped by
+// the ID the sender was told about them with
+var joins = make(map[string]join)
+var joinsMu sync.Mutex
+
 var port int
 
+// Per-phase timeouts, so that clients that stop responding don't hold
+// onto a goroutine forever
+var (
+	handshakeTimeout time.Duration // for handshake and send/recv request
+	idleTimeout      time.Duration // for no data moving between paired peers
+)
+
+// Transfers are given this long to finish when shutting down
+var drainTimeout time.Duration
+
+// Bandwidth the relay spends on all transfers together, and on each one,
+// zero meaning no limit
+var (
+	maxBandwidth    ratelimit.Rate
+	maxTransferRate ratelimit.Rate
+	bandwidth       *ratelimit.Limiter // shared by all transfers, made from maxBandwidth
+)
+
+// Address to serve metrics on, disabled if empty
+var metricsAddr string
+
+// Tracks connections and transfers, so that shutdown can wait for them
+var (
+	conns            sync.WaitGroup
+	transfersAborted atomic.Int64
+
+	// Cancelled once drainTimeout passes during shutdown,
+	// closing connections of transfers still in progress
+	abortCtx, abortTransfers = context.WithCancel(context.Background())
+)
+
+// How long share codes stay valid, senders can ask for
+// a different ttl but not over maxTTL
+var (
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+)
+
 func main() {
 	flag.IntVar(&port, "p", 3030, "Server port")
+	flag.DurationVar(&handshakeTimeout, "handshake-timeout", 10*time.Second, "Time limit for clients to complete the handshake and make a request")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 10*time.Minute, "Close paired connections when no data moves for this long, 0 for no limit")
+	flag.DurationVar(&defaultTTL, "ttl", 10*time.Minute, "How long share codes stay valid unless sender asks otherwise")
+	flag.DurationVar(&maxTTL, "max-ttl", time.Hour, "Longest ttl senders can ask for")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics over HTTP on this address, like localhost:9090 (disabled by default)")
+	flag.DurationVar(&drainTimeout, "drain-timeout", time.Minute, "On SIGTERM or SIGINT, time given to transfers in progress to finish")
+	flag.StringVar(&tlsCertFile, "tls-cert", "", "Serve clients over TLS with this PEM certificate, needs -tls-key")
+	flag.StringVar(&tlsKeyFile, "tls-key", "", "PEM private key of -tls-cert")
+	flag.BoolVar(&tlsSelfSigned, "tls-self-signed", false, "Serve clients over TLS with a certificate generated on startup, for development")
+	flag.IntVar(&lookupBurst, "lookup-burst", 10, "Failed share code lookups an IP can make in a row before getting banned, 0 to never ban")
+	flag.DurationVar(&lookupRefill, "lookup-refill", 30*time.Second, "An IP gets back one failed share code lookup every this long")
+	flag.DurationVar(&banDuration, "ban-duration", 15*time.Minute, "How long IPs making too many failed share code lookups are banned for")
+	flag.IntVar(&maxWrongPeers, "max-wrong-peers", 0, "Invalidate a fan-out share code once this many receivers had a different one, 0 for no limit")
+	flag.Var(&maxBandwidth, "max-bandwidth", "Limit how fast data is relayed for all transfers together to this `rate`, like 100MB/s (default no limit)")
+	flag.Var(&maxTransferRate, "max-transfer-rate", "Limit how fast data is relayed for each transfer to this `rate`, like 20MB/s (default no limit)")
+	flag.StringVar(&storeDir, "store-dir", "", "Keep uploads of senders passing -async in this directory, disabled if not given")
+	flag.Var(&storeQuota, "store-quota", "Most space all uploads in -store-dir may take together, a `size` like 10GB (default no limit)")
+	flag.DurationVar(&storeTTL, "store-ttl", 24*time.Hour, "How long uploads are kept, senders can ask for less")
+	flag.IntVar(&storeDownloads, "store-downloads", 1, "Delete uploads after they're downloaded this many times")
+	flag.StringVar(&tokensFile, "tokens", "", "Only serve clients with an API token listed in this JSON file, open to anyone if not given")
 	flag.Parse()
+	defaultTTL = min(defaultTTL, maxTTL)
+	bandwidth = ratelimit.New(int64(maxBandwidth))
+	if maxBandwidth > 0 {
+		log.Printf("Limiting bandwidth to %s for all transfers together\n", maxBandwidth)
+	}
+	if maxTransferRate > 0 {
+		log.Printf("Limiting bandwidth to %s per transfer\n", maxTransferRate)
+	}
 
+	if tokensFile != "" {
+		var err error
+		tokens, err = loadTokens(tokensFile)
+		if err != nil {
+			log.Fatalf("Error loading API tokens: %v\n", err)
+		}
+		log.Printf("Requiring API tokens, %d loaded\n", len(tokens))
+	}
+
+	if storeDir != "" {
+		if storeDownloads < 1 {
+			log.Fatalf("-store-downloads must be at least 1\n")
+		}
+		if err := loadUploads(time.Now()); err != nil {
+			log.Fatalf("Error loading uploads: %v\n", err)
+		}
+		log.Printf("Keeping uploads in %q for up to %s, %d kept taking %s\n", storeDir, storeTTL, len(uploads), utils.ReadableSize(storedBytes))
+		if storeQuota > 0 {
+			log.Printf("Limiting uploads to %s in total\n", storeQuota)
+		}
+	} else {
+		serverCapabilities = slices.DeleteFunc(slices.Clone(serverCapabilities), func(c string) bool {
+			return c == proto.CapStore
+		})
+	}
+
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		log.Fatalf("Error loading TLS certificate: %v\n", err)
+	}
 	address := fmt.Sprintf("0.0.0.0:%d", port)
 	ln, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatalf("Error initializing listener: %v\n", err)
 	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+		log.Printf("Serving TLS, certificate fingerprint %s\n", fingerprint(tlsConfig.Certificates[0]))
+	}
+
+	// Stop accepting connections on SIGTERM or SIGINT, see shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	context.AfterFunc(ctx, func() { ln.Close() })
 
 	log.Printf("Server running on %v...\n", address)
+	go reapExpiredSenders(reapInterval)
+	if metricsAddr != "" {
+		go serveMetrics(metricsAddr)
+	}
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
 			log.Printf("Error accepting conn: %v\n", err)
 			continue
 		}
-		go handleConn(conn)
+		conns.Add(1)
+		activeConns.Add(1)
+		go func() {
+			defer conns.Done()
+			defer activeConns.Add(-1)
+			handleConn(ctx, conn)
+		}()
 	}
+	stop() // a second signal kills us right away
+	shutdown()
 }
 
-func readFrameWithLog(conn net.Conn) (opcode proto.Opcode, payload []byte, err error) {
-	opcode, payload, err = proto.ReadFrame(conn)
-	log.Printf("read frame, opcode=%s, payload=%s, err=%v\n", opcode, payload, err)
+// Tells waiting senders that we're going away, and waits for transfers
+// in progress to finish, aborting ones that don't within drainTimeout
+func shutdown() {
+	endedBefore := transfersCompleted.Load() + transfersFailed.Load()
+	log.Printf("Shutting down, draining transfers for up to %s...\n", drainTimeout)
+
+	sendersMu.Lock()
+	shuttingDown = true
+	for channel, sender := range senders {
+		delete(senders, channel)
+		sender.evicted <- proto.ErrorPayload{
+			Code:    proto.ErrShuttingDown,
+			Message: "relay is shutting down, try sending again later",
+		}
+	}
+	sendersMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		log.Printf("Drain timeout passed, aborting remaining transfers\n")
+		abortTransfers()
+		<-done
+	}
+	ended := transfersCompleted.Load() + transfersFailed.Load() - endedBefore
+	aborted := transfersAborted.Load()
+	log.Printf("Shutdown complete, %d transfers drained, %d aborted\n", ended-aborted, aborted)
+}
+
+func readFrameWithLog(ctx context.Context, conn net.Conn) (opcode proto.Opcode, payload []byte, err error) {
+	opcode, payload, err = proto.ReadFrameContext(ctx, conn)
+	log.Printf("read frame, opcode=%s, payload=%s, err=%v\n", opcode, redact(opcode, payload), err)
 	return
 }
 
-func writeFrameWithLog(conn net.Conn, opcode proto.Opcode, payload []byte) (n int, err error) {
-	n, err = proto.WriteFrame(conn, opcode, payload)
+// Returns payload with client's API token hidden, so that
+// it doesn't end up in our logs
+func redact(opcode proto.Opcode, payload []byte) []byte {
+	if opcode != proto.OpcodeHandshakeRequest || len(payload) == 0 {
+		return payload // old clients send nothing
+	}
+	req, err := proto.ParseJSON[proto.HandshakeRequestPayload](payload)
+	if err != nil {
+		return []byte("(malformed)")
+	}
+	if req.Token != "" {
+		req.Token = "REDACTED"
+	}
+	return proto.JSONToBytes(req)
+}
+
+func writeFrameWithLog(ctx context.Context, conn net.Conn, opcode proto.Opcode, payload []byte) (n int, err error) {
+	n, err = proto.WriteFrameContext(ctx, conn, opcode, payload)
 	log.Printf("wrote frame, conn=%s opcode=%s, payload=%s\n", conn.RemoteAddr().String(), opcode, payload)
 	return
 }
 
-func handleConn(conn net.Conn) {
+func writeErrorWithLog(conn net.Conn, code proto.ErrorCode, format string, a ...any) {
+	_, err := proto.WriteError(conn, code, format, a...)
+	log.Printf("wrote error, conn=%s code=%s, message=%q, err=%v\n", conn.RemoteAddr().String(), code, fmt.Sprintf(format, a...), err)
+}
+
+// Tells a waiting sender that transfers are being aborted. Any deadline
+// left by the abort is replaced, so that a sender not reading can't hold
+// up shutdown either.
+func writeAbortedWithLog(conn net.Conn) {
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	writeErrorWithLog(conn, proto.ErrShuttingDown, "relay is shutting down, try sending again later")
+}
+
+func handleConn(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 	defer func() {
 		log.Printf("deferred function, conn=%s\n", conn.RemoteAddr().String())
@@ -88,238 +324,666 @@ func handleConn(conn net.Conn) {
 	addr := conn.RemoteAddr().String()
 	log.Printf("new connection, conn=%s\n", addr)
 
-	var opcode proto.Opcode
-	var payload []byte
-	var err error
-	_ = err
-
-	opcode, payload, err = readFrameWithLog(conn)
+	// Client has limited time to tell us what it wants,
+	// including the TLS handshake if we're serving TLS
+	hctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.HandshakeContext(hctx); err != nil {
+			if hctx.Err() != nil {
+				handshakeFailed(conn, hctx.Err())
+				return
+			}
+			log.Printf("TLS handshake failed, conn=%s err=%v\n", addr, err)
+			handshakeFailures.inc(reasonTLS)
+			return
+		}
+	}
+	opcode, payload, err := readFrameWithLog(hctx, conn)
+	if err != nil {
+		handshakeFailed(conn, err)
+		return
+	}
+	if wait := bannedFor(clientIP(conn), time.Now()); wait > 0 {
+		handshakeFailures.inc(reasonBanned)
+		writeFrameWithLog(hctx, conn, proto.OpcodeError, proto.JSONToBytes(proto.ErrorPayload{
+			Code:       proto.ErrRateLimited,
+			Message:    "too many failed share code lookups",
+			RetryAfter: int((wait + time.Second - 1) / time.Second),
+		}))
+		return
+	}
 	if opcode != proto.OpcodeHandshakeRequest {
+		handshakeFailures.inc(reasonBadRequest)
+		writeErrorWithLog(conn, proto.ErrBadRequest, "expected a handshake request, got %s", opcode)
+		return
+	}
+	capabilities, access, ok := completeHandshake(hctx, conn, payload)
+	if !ok {
 		return
 	}
-	writeFrameWithLog(conn, proto.OpcodeHandshakeResponse, nil)
 
-	opcode, payload, err = readFrameWithLog(conn)
-	if opcode == proto.OpcodeFileSendRequest {
-		req := proto.DecodeJSON[proto.FileSendRequestPayload](payload)
+	opcode, payload, err = readFrameWithLog(hctx, conn)
+	if err != nil {
+		handshakeFailed(conn, err)
+		return
+	}
+	cancel()
 
-		// If client gave a custom share code, make sure it is not already
-		// used. If already used, close the connection.
-		// If share code was not given, we generate a unique code ourselves
-		shareCode := req.ShareCode
-		sendersMu.Lock()
-		if shareCode == "" {
-			for {
-				shareCode = utils.RandCode()
-				if _, exists := senders[shareCode]; !exists {
-					break
-				}
-			}
-		} else {
-			_, exists := senders[shareCode]
-			if exists {
-				writeFrameWithLog(conn, proto.OpcodeShareCodeNotAvailable, nil)
-				return
-			}
+	// Requests that made it in before shutdown are let through,
+	// they're aborted only if they don't finish while draining
+	if ctx.Err() != nil {
+		handshakeFailures.inc(reasonShuttingDown)
+		writeErrorWithLog(conn, proto.ErrShuttingDown, "relay is shutting down, try again later")
+		return
+	}
+	ctx = abortCtx
+
+	switch opcode {
+	case proto.OpcodeFileSendRequest:
+		req, err := proto.ParseJSON[proto.FileSendRequestPayload](payload)
+		if err != nil {
+			handshakeFailures.inc(reasonBadRequest)
+			writeErrorWithLog(conn, proto.ErrBadRequest, "malformed send request: %v", err)
+			return
 		}
-		// Store the sender details int a global map
-		sender := sender{
-			conn:                conn,
-			waitTillConsumption: make(chan struct{}),
-			shareCode:           shareCode,
-			filename:            req.Filename,
-			filesize:            req.Filesize,
+		if !permitSend(conn, access, req.Size) {
+			return
 		}
-		senders[shareCode] = sender
-		sendersMu.Unlock()
-		defer func() {
-			sendersMu.Lock()
-			delete(senders, sender.shareCode)
-			sendersMu.Unlock()
-		}()
+		handleSender(ctx, conn, req, capabilities, access)
+	case proto.OpcodeFileRecvRequest:
+		req, err := proto.ParseJSON[proto.FileRecvRequestPayload](payload)
+		if err != nil {
+			handshakeFailures.inc(reasonBadRequest)
+			writeErrorWithLog(conn, proto.ErrBadRequest, "malformed recv request: %v", err)
+			return
+		}
+		if !access.Recv {
+			handshakeFailures.inc(reasonForbidden)
+			writeErrorWithLog(conn, proto.ErrForbidden, "API token of %q doesn't allow receiving", access.Name)
+			return
+		}
+		handleRecver(ctx, conn, req, capabilities, access)
+	case proto.OpcodeServeReceiver:
+		req, err := proto.ParseJSON[proto.ServeReceiverPayload](payload)
+		if err != nil {
+			handshakeFailures.inc(reasonBadRequest)
+			writeErrorWithLog(conn, proto.ErrBadRequest, "malformed serve request: %v", err)
+			return
+		}
+		if !permitSend(conn, access, 0) {
+			return
+		}
+		handleServingSender(conn, req, capabilities, access)
+	case proto.OpcodeStoreRequest:
+		req, err := proto.ParseJSON[proto.StoreRequestPayload](payload)
+		if err != nil {
+			handshakeFailures.inc(reasonBadRequest)
+			writeErrorWithLog(conn, proto.ErrBadRequest, "malformed store request: %v", err)
+			return
+		}
+		if storeDir == "" {
+			handshakeFailures.inc(reasonBadRequest)
+			writeErrorWithLog(conn, proto.ErrBadRequest, "relay doesn't keep uploads")
+			return
+		}
+		if !permitSend(conn, access, req.Size) {
+			return
+		}
+		handleStore(ctx, conn, req, access)
+	default:
+		handshakeFailures.inc(reasonBadRequest)
+		writeErrorWithLog(conn, proto.ErrBadRequest, "expected a send or recv request, got %s", opcode)
+	}
+}
 
-		writeFrameWithLog(
-			conn,
-			proto.OpcodeFileSendResponse,
-			proto.JSONToBytes(
-				proto.FileSendResponsePayload{ShareCode: shareCode},
-			),
-		)
+// Checks that a client with access may send size bytes,
+// telling them why not otherwise
+func permitSend(conn net.Conn, access access, size int64) bool {
+	switch {
+	case !access.Send:
+		handshakeFailures.inc(reasonForbidden)
+		writeErrorWithLog(conn, proto.ErrForbidden, "API token of %q doesn't allow sending", access.Name)
+		return false
+	case access.tooLarge(size):
+		handshakeFailures.inc(reasonForbidden)
+		writeErrorWithLog(conn, proto.ErrTooLarge, "file is over the %d bytes API token of %q allows", access.MaxFileSize, access.Name)
+		return false
+	}
+	return true
+}
 
-		// Wail till file is consumed by some receiver
-		<-sender.waitTillConsumption
+func handleSender(ctx context.Context, conn net.Conn, req proto.FileSendRequestPayload, capabilities []string, access access) {
+	// If client asked for a custom channel, make sure it is not already
+	// used. If already used, close the connection.
+	// If channel was not given, we allocate a unique one ourselves.
+	// Channels are matched case-insensitively.
+	channel := strings.ToLower(req.Channel)
+	sendersMu.Lock()
+	if shuttingDown {
+		// Made it in before shutdown, but would never get evicted
+		sendersMu.Unlock()
+		writeErrorWithLog(conn, proto.ErrShuttingDown, "relay is shutting down, try sending again later")
+		return
+	}
+	if channel == "" {
+		channel = allocChannel()
+	} else if channelInUse(channel) {
+		sendersMu.Unlock()
+		writeErrorWithLog(conn, proto.ErrShareCodeNotAvailable, "share code channel %q is already in use", channel)
+		return
+	}
+	// Store the sender details int a global map
+	ttl := defaultTTL
+	if req.TTL > 0 {
+		ttl = min(time.Duration(req.TTL)*time.Second, maxTTL)
+	}
+	sender := sender{
+		conn:                conn,
+		waitTillConsumption: make(chan struct{}),
+		channel:             channel,
+		capabilities:        capabilities,
+		access:              access,
+		size:                req.Size,
+		createdAt:           time.Now(),
+		ttl:                 ttl,
+		evicted:             make(chan proto.ErrorPayload, 1),
+		receivers:           1,
+		left:                make(chan struct{}),
+	}
+	if req.Receivers != 0 && req.Receivers != 1 {
+		sender.receivers = req.Receivers
+		sender.joined = make(chan string)
+	}
+	senders[channel] = sender
+	sendersMu.Unlock()
+	defer func() {
+		sendersMu.Lock()
+		if senders[sender.channel].conn == conn {
+			delete(senders, sender.channel)
+		}
+		sendersMu.Unlock()
+		close(sender.left)
+	}()
 
-	} else if opcode == proto.OpcodeFileRecvRequest {
-		req := proto.DecodeJSON[proto.FileRecvRequestPayload](payload)
+	writeFrameWithLog(
+		ctx,
+		conn,
+		proto.OpcodeFileSendResponse,
+		proto.JSONToBytes(
+			proto.FileSendResponsePayload{
+				Channel:   channel,
+				ExpiresIn: int(ttl / time.Second),
+			},
+		),
+	)
+
+	if sender.joined != nil {
+		serveFanout(ctx, sender, req.Receivers)
+		return
+	}
 
-		// Make sure the share code provided is valid
+	// Wail till file is consumed by some receiver,
+	// or share code expires without anyone showing up
+	select {
+	case <-sender.waitTillConsumption:
+	case reason := <-sender.evicted:
+		writeErrorWithLog(conn, reason.Code, "%s", reason.Message)
+	case <-ctx.Done():
+		// Transfers are being aborted, a receiver that claimed us
+		// is being cut off as well
 		sendersMu.Lock()
-		sender, exists := senders[req.ShareCode]
+		unclaimed := senders[sender.channel].conn == conn
 		sendersMu.Unlock()
-		if !exists {
-			writeFrameWithLog(conn, proto.OpcodeShareCodeNotFound, nil)
-			return
+		if unclaimed {
+			writeAbortedWithLog(conn)
 		}
+	}
+}
 
-		// Notify receiver about file's name and size
-		fileDetails := proto.FileRecvResponsePayload{
-			Filesize: sender.filesize,
-			Filename: sender.filename,
+// Tells a fan-out sender about receivers as they show up, until it has been
+// told about as many as it wanted, it goes away, or the share code expires
+// or gets invalidated
+func serveFanout(ctx context.Context, sender sender, receivers int) {
+	// Sender only tells us about receivers that had a different
+	// share code on this connection, reading also tells us when it's gone
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		wrongPeers := 0
+		for {
+			opcode, payload, err := proto.ReadFrame(sender.conn)
+			if err != nil {
+				return
+			}
+			if opcode != proto.OpcodeWrongPeer {
+				continue
+			}
+			wrongPeers++
+			log.Printf("wrong peer, channel=%q payload=%s count=%d\n", sender.channel, payload, wrongPeers)
+			if maxWrongPeers > 0 && wrongPeers == maxWrongPeers {
+				invalidate(sender, wrongPeers)
+			}
 		}
-		writeFrameWithLog(conn, proto.OpcodeFileRecvResponse, proto.JSONToBytes(fileDetails))
-
-		// Wait until receiver is ready to recieve
-		opcode, _, _ := readFrameWithLog(conn)
+	}()
 
-		if opcode != proto.OpcodeReadyToRecieve {
-			log.Printf("Unexpected opcode from receiver while waiting for readiness, have (%d) want (%d)\n", opcode, proto.OpcodeReadyToRecieve)
+	for told := 0; receivers < 0 || told < receivers; told++ {
+		select {
+		case id := <-sender.joined:
+			_, err := writeFrameWithLog(ctx, sender.conn, proto.OpcodeReceiverJoined, proto.JSONToBytes(proto.ReceiverJoinedPayload{
+				ID: id,
+			}))
+			if err != nil {
+				return
+			}
+		case reason := <-sender.evicted:
+			writeErrorWithLog(sender.conn, reason.Code, "%s", reason.Message)
+			return
+		case <-ctx.Done():
+			writeAbortedWithLog(sender.conn)
+			return
+		case <-gone:
 			return
 		}
-		// Since receiver is ready now, we notify sender
-		// that they can start receiving now
-		writeFrameWithLog(sender.conn, proto.OpcodeCanStartSending, nil)
+	}
+}
 
-		// Then read from sender's conn and write to reciever's conn
-		sent, err := io.CopyN(conn, sender.conn, sender.filesize)
-		if err != nil {
-			log.Printf("Error streaming data to receiver: %s\n", err)
+// Removes a fan-out sender after too many receivers had a different share
+// code, so that the share code can't be guessed by trying it over and over
+func invalidate(sender sender, wrongPeers int) {
+	sendersMu.Lock()
+	defer sendersMu.Unlock()
+	if senders[sender.channel].conn != sender.conn {
+		return // expired or went away already
+	}
+	log.Printf("share code invalidated, channel=%q conn=%s\n", sender.channel, sender.conn.RemoteAddr().String())
+	invalidatedCodes.Add(1)
+	delete(senders, sender.channel)
+	sender.evicted <- proto.ErrorPayload{
+		Code:    proto.ErrShareCodeInvalidated,
+		Message: fmt.Sprintf("share code invalidated after %d receivers had a different one", wrongPeers),
+	}
+}
+
+func handleRecver(ctx context.Context, conn net.Conn, req proto.FileRecvRequestPayload, capabilities []string, access access) {
+	// Make sure the channel provided is valid, and claim the sender
+	// so that no other receiver gets paired with them. Fan-out senders
+	// stay around until as many receivers as they wanted have claimed them.
+	// Senders of files too large for the receiver are left for others.
+	req.Channel = strings.ToLower(req.Channel)
+	sendersMu.Lock()
+	sender, exists := senders[req.Channel]
+	tooLarge := exists && access.tooLarge(sender.size)
+	upload, stored := uploads[req.Channel]
+	if !exists && stored {
+		tooLarge = upload.complete && access.tooLarge(upload.Size)
+		sendersMu.Unlock()
+		if tooLarge {
+			handshakeFailures.inc(reasonForbidden)
+			writeErrorWithLog(conn, proto.ErrTooLarge, "file is over the %d bytes API token of %q allows", access.MaxFileSize, access.Name)
 			return
 		}
-		// All (or some) data has been sent at this point, so we should unblock the sender
-		defer close(sender.waitTillConsumption)
-		if sent != sender.filesize {
-			log.Printf("Couldn't sent whole file, sent (%d/%d) bytes\n", sent, sender.filesize)
+		handleFetch(ctx, conn, upload, capabilities)
+		return
+	}
+	switch {
+	case tooLarge:
+	case exists && sender.receivers == 1:
+		delete(senders, req.Channel)
+	case exists && sender.receivers > 1:
+		sender.receivers--
+		senders[req.Channel] = sender
+	}
+	sendersMu.Unlock()
+	if !exists {
+		lookupFailed(clientIP(conn), time.Now())
+		writeErrorWithLog(conn, proto.ErrShareCodeNotFound, "no sender is waiting on share code channel %q", req.Channel)
+		return
+	}
+	if tooLarge {
+		handshakeFailures.inc(reasonForbidden)
+		writeErrorWithLog(conn, proto.ErrTooLarge, "file is over the %d bytes API token of %q allows", access.MaxFileSize, access.Name)
+		return
+	}
+
+	if sender.joined != nil {
+		serving, err := waitForServingSender(ctx, sender)
+		if err != nil {
+			writeErrorWithLog(conn, proto.ErrShareCodeNotFound, "%v", err)
 			return
 		}
-		log.Printf("Sent %d bytes from %s -> %s\n", sent, sender.conn.RemoteAddr().String(), addr)
+		defer close(serving.done)
+		relay(ctx, serving.conn, serving.capabilities, conn, capabilities, relayLimit(serving.access, access))
+		return
+	}
+
+	// Whatever happens, the sender should be unblocked once we're done
+	defer close(sender.waitTillConsumption)
+	relay(ctx, sender.conn, sender.capabilities, conn, capabilities, relayLimit(sender.access, access))
+}
 
+// Tells a fan-out sender that a receiver is waiting, and waits
+// for it to connect again to serve them
+func waitForServingSender(ctx context.Context, sender sender) (servingSender, error) {
+	id, err := randomID()
+	if err != nil {
+		return servingSender{}, fmt.Errorf("couldn't pick a receiver id: %w", err)
+	}
+	j := join{channel: sender.channel, served: make(chan servingSender, 1)}
+	joinsMu.Lock()
+	joins[id] = j
+	joinsMu.Unlock()
+	forget := func() (pending bool) {
+		joinsMu.Lock()
+		defer joinsMu.Unlock()
+		_, pending = joins[id]
+		delete(joins, id)
+		return pending
 	}
 
-	return
+	select {
+	case sender.joined <- id:
+	case <-sender.left:
+		forget()
+		return servingSender{}, fmt.Errorf("sender on share code channel %q has gone away", sender.channel)
+	}
+	timer := time.NewTimer(handshakeTimeout)
+	defer timer.Stop()
+	select {
+	case serving := <-j.served:
+		return serving, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	if !forget() {
+		return <-j.served, nil // sender got here just now
+	}
+	return servingSender{}, fmt.Errorf("sender on share code channel %q didn't connect to serve us", sender.channel)
+}
 
-	for {
-		opcode, payload, err := proto.ReadFrame(conn)
-		log.Printf("In for loop, opcode=%d, payload=%s, err=%v\n", opcode, payload, err)
+// Hands a fan-out sender's new connection to the receiver it's serving,
+// and waits for their transfer to be over
+func handleServingSender(conn net.Conn, req proto.ServeReceiverPayload, capabilities []string, access access) {
+	joinsMu.Lock()
+	j, exists := joins[req.ID]
+	exists = exists && j.channel == strings.ToLower(req.Channel)
+	if exists {
+		delete(joins, req.ID)
+	}
+	joinsMu.Unlock()
+	if !exists {
+		writeErrorWithLog(conn, proto.ErrShareCodeNotFound, "no receiver is waiting on share code channel %q with id %q", req.Channel, req.ID)
+		return
+	}
+	done := make(chan struct{})
+	j.served <- servingSender{conn: conn, capabilities: capabilities, access: access, done: done}
+	<-done
+}
+
+// Notifies both peers that they have been paired, along with what
+// the other one supports. From here on they talk to each other
+// end-to-end encrypted, we just pipe the bytes, up to limit bytes
+// from sender to receiver if it isn't 0, as fast as the bandwidth
+// limits allow. Receivers the sender reports as having a different
+// share code count as failed lookups.
+func relay(ctx context.Context, senderConn net.Conn, senderCaps []string, recverConn net.Conn, recverCaps []string, limit int64) {
+	writeFrameWithLog(ctx, recverConn, proto.OpcodeFileRecvResponse, proto.JSONToBytes(proto.PairedPayload{
+		Capabilities: senderCaps,
+	}))
+	writeFrameWithLog(ctx, senderConn, proto.OpcodeCanStartSending, proto.JSONToBytes(proto.PairedPayload{
+		Capabilities: recverCaps,
+	}))
+
+	transfersStarted.Add(1)
+	start := time.Now()
+	limiters := []*ratelimit.Limiter{bandwidth, ratelimit.New(int64(maxTransferRate))}
+	wrongPeer := func() {
+		// Receiver had a different share code, which counts
+		// the same as asking for one nobody is sending on
+		log.Printf("wrong peer, conn=%s\n", recverConn.RemoteAddr().String())
+		lookupFailed(clientIP(recverConn), time.Now())
+	}
+	toRecver, toSender, err := pipe(ctx, senderConn, recverConn, idleTimeout, limit, limiters, wrongPeer)
+	transferDuration.observe(time.Since(start).Seconds())
+	switch {
+	case errors.Is(err, context.Canceled):
+		transfersAborted.Add(1)
+		transfersFailed.Add(1)
+		log.Printf("Aborted transfer %s -> %s: %v\n", senderConn.RemoteAddr().String(), recverConn.RemoteAddr().String(), err)
+	case err != nil:
+		transfersFailed.Add(1)
+		log.Printf("Transfer failed %s -> %s: %v\n", senderConn.RemoteAddr().String(), recverConn.RemoteAddr().String(), err)
+	default:
+		transfersCompleted.Add(1)
+	}
+	log.Printf("Relayed %d bytes %s -> %s, %d bytes back\n", toRecver, senderConn.RemoteAddr().String(), recverConn.RemoteAddr().String(), toSender)
+}
+
+// Agrees on protocol version and capabilities with a client, given their
+// handshake request payload, and checks their API token. Returns
+// capabilities supported by both of us and what the client may do.
+func completeHandshake(ctx context.Context, conn net.Conn, payload []byte) (capabilities []string, a access, ok bool) {
+	req := proto.HandshakeRequestPayload{Version: 1} // old clients send nothing
+	if len(payload) > 0 {
+		var err error
+		req, err = proto.ParseJSON[proto.HandshakeRequestPayload](payload)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Printf("Error reading from %s: %v\n", addr, err)
-			break
-		}
-		switch opcode {
-		case proto.OpcodeHandshakeRequest:
-			proto.WriteFrame(conn, proto.OpcodeHandshakeResponse, nil)
-
-		case proto.OpcodeFileSendRequest:
-			log.Printf("%s is trying to send\n", addr)
-			req := proto.DecodeJSON[proto.FileSendRequestPayload](payload)
-
-			// If client gave a custom share code, make sure it is not already
-			// used. If already used, close the connection.
-			// If share code was not given, we generate a unique code ourselves
-			shareCode := req.ShareCode
-			sendersMu.Lock()
-			if shareCode == "" {
-				for {
-					shareCode = utils.RandCode()
-					if _, exists := senders[shareCode]; !exists {
-						break
-					}
-				}
-			} else {
-				_, exists := senders[shareCode]
-				if exists {
-					proto.WriteFrame(conn, proto.OpcodeShareCodeNotAvailable, nil)
-					return
-				}
-			}
-			// Store the sender details int a global map
-			sender := sender{
-				conn:                conn,
-				waitTillConsumption: make(chan struct{}),
-				shareCode:           shareCode,
-				filename:            req.Filename,
-				filesize:            req.Filesize,
-			}
-			senders[shareCode] = sender
-			sendersMu.Unlock()
-			defer func() {
-				sendersMu.Lock()
-				delete(senders, sender.shareCode)
-				sendersMu.Unlock()
-			}()
-
-			proto.WriteFrame(
-				conn,
-				proto.OpcodeFileSendResponse,
-				proto.JSONToBytes(
-					proto.FileSendResponsePayload{ShareCode: shareCode},
-				),
-			)
-
-			// Wail till file is consumed by some receiver
-			<-sender.waitTillConsumption
-
-		case proto.OpcodeFileRecvRequest:
-			log.Printf("%s is trying to recv\n", addr)
-			req := proto.DecodeJSON[proto.FileRecvRequestPayload](payload)
-
-			// Make sure the share code provided is valid
-			sendersMu.Lock()
-			sender, exists := senders[req.ShareCode]
-			sendersMu.Unlock()
-			if !exists {
-				proto.WriteFrame(conn, proto.OpcodeShareCodeNotFound, nil)
-				break
-			}
+			handshakeFailures.inc(reasonBadRequest)
+			writeErrorWithLog(conn, proto.ErrBadRequest, "malformed handshake request: %v", err)
+			return nil, access{}, false
+		}
+	}
+	resp := proto.HandshakeResponsePayload{
+		Version:      min(req.Version, proto.ProtocolVersion),
+		MinVersion:   proto.MinProtocolVersion,
+		Capabilities: proto.IntersectCapabilities(req.Capabilities, serverCapabilities),
+		ObservedAddr: conn.RemoteAddr().String(),
+	}
+	if resp.Version < proto.MinProtocolVersion {
+		log.Printf("Client too old, conn=%s version=%d\n", conn.RemoteAddr().String(), req.Version)
+		handshakeFailures.inc(reasonVersionMismatch)
+		writeFrameWithLog(ctx, conn, proto.OpcodeVersionMismatch, proto.JSONToBytes(resp))
+		return nil, access{}, false
+	}
+	a, err := authorize(req.Token)
+	if err != nil {
+		log.Printf("Client unauthorized, conn=%s err=%v\n", conn.RemoteAddr().String(), err)
+		handshakeFailures.inc(reasonUnauthorized)
+		writeErrorWithLog(conn, proto.ErrUnauthorized, "%v", err)
+		return nil, access{}, false
+	}
+	writeFrameWithLog(ctx, conn, proto.OpcodeHandshakeResponse, proto.JSONToBytes(resp))
+	return resp.Capabilities, a, true
+}
 
-			// Notify receiver about file's name and size
-			fileDetails := proto.FileRecvResponsePayload{
-				Filesize: sender.filesize,
-				Filename: sender.filename,
-			}
-			proto.WriteFrame(conn, proto.OpcodeFileRecvResponse, proto.JSONToBytes(fileDetails))
+// Copies data in both directions between sender and receiver until
+// either side is done, or no data moves in either direction for
+// idleTimeout, or sender goes over limit bytes if it isn't 0, then
+// closes both connections. Reads in both directions wait on limiters.
+// wrongPeer is called if the sender reports the receiver had a
+// different share code, see [forwardKeyExchange].
+// Returns ctx's error if it was cut short
+// due to ctx being done, or the first error copying in either direction.
+func pipe(ctx context.Context, senderConn, recverConn net.Conn, idleTimeout time.Duration, limit int64, limiters []*ratelimit.Limiter, wrongPeer func()) (toRecver, toSender int64, err error) {
+	var wg sync.WaitGroup
+	var once, errOnce sync.Once
+	var copyErr error
+	exchanged := make(chan struct{}) // sender is past the key exchange
+	closeBoth := func() {
+		senderConn.Close()
+		recverConn.Close()
+	}
+	fail := func(err error) {
+		// Closing the connections makes the other copy fail, that's not an error
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			errOnce.Do(func() { copyErr = err })
+		}
+	}
+	touch := func() {
+		if idleTimeout > 0 {
+			deadline := time.Now().Add(idleTimeout)
+			senderConn.SetDeadline(deadline)
+			recverConn.SetDeadline(deadline)
+		}
+	}
+	touch()
+	stop := context.AfterFunc(ctx, func() { once.Do(closeBoth) })
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		src := ratelimit.NewReader(activityReader{senderConn, &bytesToRecver, touch}, limiters...)
+		if limit > 0 {
+			src = io.LimitReader(src, limit+1)
+		}
+		var err error
+		var reported bool
+		toRecver, reported, err = forwardKeyExchange(recverConn, src)
+		close(exchanged)
+		if reported {
+			wrongPeer()
+		} else if err == nil {
+			var n int64
+			n, err = io.Copy(recverConn, src)
+			toRecver += n
+		}
+		if limit > 0 && toRecver > limit {
+			err = errOverLimit
+		}
+		fail(err)
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		var err error
+		toSender, err = io.Copy(senderConn, ratelimit.NewReader(activityReader{recverConn, &bytesToSender, touch}, limiters...))
+		fail(err)
+		// Receivers hang up as soon as they find out the share codes
+		// don't match, sender gets a moment to tell us about it
+		timer := time.NewTimer(handshakeTimeout)
+		select {
+		case <-exchanged:
+		case <-timer.C:
+		}
+		timer.Stop()
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+	if !stop() {
+		return toRecver, toSender, ctx.Err()
+	}
+	return toRecver, toSender, copyErr
+}
 
-			// Wait until receiver is ready to recieve
-			opcode, _, _ := proto.ReadFrame(conn)
-			if opcode != proto.OpcodeReadyToRecieve {
-				log.Printf("Unexpected opcode from receiver while waiting for readiness, have (%d) want (%d)\n", opcode, proto.OpcodeReadyToRecieve)
-				return
-			}
-			// Since receiver is ready now, we notify sender
-			// that they can start receiving now
-			proto.WriteFrame(sender.conn, proto.OpcodeCanStartSending, nil)
+var errOverLimit = errors.New("sender went over the size limit")
+
+// Frames sender sends for the key exchange, the frame after them is
+// OpcodeWrongPeer instead of whatever it would have sent encrypted if
+// the receiver had a different share code
+const keyExchangeFrames = 2
+
+// Forwards frames of the sender's key exchange from src to dst, and the
+// one after them unless it reports a wrong peer, which is meant for us.
+// Sender is read from until then even if dst is gone, since receivers
+// with a different share code don't stick around. Returns bytes forwarded.
+func forwardKeyExchange(dst io.Writer, src io.Reader) (forwarded int64, reported bool, err error) {
+	var writeErr error
+	for range keyExchangeFrames + 1 {
+		opcode, payload, err := proto.ReadFrame(src)
+		if err == io.EOF {
+			return forwarded, false, writeErr // sender is done, not an error
+		}
+		if err != nil {
+			return forwarded, false, err
+		}
+		if opcode == proto.OpcodeWrongPeer {
+			return forwarded, true, nil
+		}
+		if writeErr == nil {
+			var n int
+			n, writeErr = proto.WriteFrame(dst, opcode, payload)
+			forwarded += int64(n)
+		}
+	}
+	return forwarded, false, writeErr
+}
 
-			// Then read rom sender's conn and write to reciever's conn
-			sent, err := io.CopyN(conn, sender.conn, sender.filesize)
-			if err != nil {
-				log.Printf("Error streaming data to receiver: %s\n", err)
-				return
-			}
-			// All (or some) data has been sent at this point, so we should unblock the sender
-			defer close(sender.waitTillConsumption)
-			if sent != sender.filesize {
-				log.Printf("Couldn't sent whole file, sent (%d/%d) bytes\n", sent, sender.filesize)
-				return
+// Counts bytes read through it and calls onRead whenever data is read
+type activityReader struct {
+	r      io.Reader
+	count  *atomic.Int64
+	onRead func()
+}
+
+func (ar activityReader) Read(p []byte) (int, error) {
+	n, err := ar.r.Read(p)
+	if n > 0 {
+		ar.count.Add(int64(n))
+		ar.onRead()
+	}
+	return n, err
+}
+
+// Records why reading client's handshake or request failed
+func handshakeFailed(conn net.Conn, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Printf("Client took too long, conn=%s\n", conn.RemoteAddr().String())
+		handshakeFailures.inc(reasonTimeout)
+	case errors.Is(err, context.Canceled):
+		handshakeFailures.inc(reasonShuttingDown)
+	default:
+		handshakeFailures.inc(reasonDisconnected)
+	}
+}
+
+// How often expired senders are looked for
+const reapInterval = 5 * time.Second
+
+// Periodically removes senders whose share code has expired, so that
+// crashed or forgotten senders don't keep their share code reserved,
+// along with expired uploads
+func reapExpiredSenders(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		sendersMu.Lock()
+		for channel, sender := range senders {
+			if now.Sub(sender.createdAt) >= sender.ttl {
+				log.Printf("share code expired, channel=%q conn=%s\n", channel, sender.conn.RemoteAddr().String())
+				delete(senders, channel)
+				reason := proto.ErrorPayload{
+					Code:    proto.ErrShareCodeExpired,
+					Message: fmt.Sprintf("share code expired, no receiver showed up within %s", sender.ttl),
+				}
+				if sender.joined != nil {
+					reason.Message = fmt.Sprintf("share code expired after %s", sender.ttl)
+				}
+				sender.evicted <- reason
 			}
-			log.Printf("Sent %d bytes from %s -> %s\n", sent, sender.conn.RemoteAddr().String(), addr)
-
-		// Invalid cases when connections are closed
-		// Server only gets requests, not responses.
-		case proto.OpcodeHandshakeResponse,
-			proto.OpcodeFileSendResponse,
-			proto.OpcodeFileRecvResponse:
-			log.Printf("Unacceptable opcode (%d) from %s, closing connection....\n", opcode, addr)
-			return
-		default:
-			log.Printf("Unrecognized opcode (%d) from %s, closing connection....\n", opcode, addr)
-			return
 		}
+		reapExpiredUploads(now)
+		sendersMu.Unlock()
+		forgetRecoveredIPs(now)
 	}
+}
 
-	return
+func randomID() (string, error) {
+	var buf [16]byte
+	if _, err := crand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
 
+// Allocates a short numeric channel that's not in use by a sender or upload,
+// must be called with sendersMu held.
+func allocChannel() string {
+	for limit := 100; ; limit *= 10 {
+		for range 10 {
+			channel := strconv.Itoa(rand.Intn(limit))
+			if !channelInUse(channel) {
+				return channel
+			}
+		}
+	}
 }
 
 // func handleClientOld(client Client) {
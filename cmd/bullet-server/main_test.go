@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/diwasrimal/bullet/pkg/proto"
+)
+
+func TestRedact(t *testing.T) {
+	const token = "s3cr3t-token"
+	withToken := proto.JSONToBytes(proto.HandshakeRequestPayload{
+		Version:      3,
+		Capabilities: []string{proto.CapEncryption},
+		Token:        token,
+	})
+	redacted := redact(proto.OpcodeHandshakeRequest, withToken)
+	if bytes.Contains(redacted, []byte(token)) {
+		t.Errorf("token wasn't redacted: %s", redacted)
+	}
+	req, err := proto.ParseJSON[proto.HandshakeRequestPayload](redacted)
+	if err != nil {
+		t.Fatalf("redacted payload doesn't parse: %v", err)
+	}
+	if req.Version != 3 || len(req.Capabilities) != 1 || req.Token == "" {
+		t.Errorf("redacted payload lost more than the token: %s", redacted)
+	}
+
+	for _, c := range []struct {
+		opcode  proto.Opcode
+		payload []byte
+	}{
+		{proto.OpcodeHandshakeRequest, proto.JSONToBytes(proto.HandshakeRequestPayload{Version: 3})},
+		{proto.OpcodeHandshakeRequest, nil},
+		{proto.OpcodeFileRecvRequest, []byte(`{"channel":"42"}`)},
+	} {
+		if got := redact(c.opcode, c.payload); !bytes.Equal(got, c.payload) {
+			t.Errorf("redact(%s, %s) = %s, want it unchanged", c.opcode, c.payload, got)
+		}
+	}
+
+	malformed := []byte(`{"token":"` + token + `"`)
+	if got := redact(proto.OpcodeHandshakeRequest, malformed); bytes.Contains(got, []byte(token)) {
+		t.Errorf("token of malformed payload wasn't redacted: %s", got)
+	}
+}
+
+// Reads what the relay tells a sender after registering it,
+// failing unless it's told the relay is shutting down
+func expectShuttingDown(t *testing.T, client net.Conn) {
+	t.Helper()
+	_, err := proto.ReadExpectedFrame(client, proto.OpcodeReceiverJoined)
+	var relayErr *proto.ErrorPayload
+	if !errors.As(err, &relayErr) || relayErr.Code != proto.ErrShuttingDown {
+		t.Fatalf("sender was told %v, want relay shutting down", err)
+	}
+}
+
+func TestShutdownWithLateSender(t *testing.T) {
+	setGlobal(t, &shuttingDown, false)
+	setGlobal(t, &drainTimeout, time.Minute)
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	// Sender connected before shutdown, but registers only
+	// after senders have been evicted
+	conns.Add(1)
+	shut := make(chan struct{})
+	go func() {
+		defer close(shut)
+		shutdown()
+	}()
+	for evicted := false; !evicted; time.Sleep(time.Millisecond) {
+		sendersMu.Lock()
+		evicted = shuttingDown
+		sendersMu.Unlock()
+	}
+	go func() {
+		defer conns.Done()
+		defer conn.Close()
+		handleSender(context.Background(), conn, proto.FileSendRequestPayload{Channel: "late"}, nil, openAccess)
+	}()
+
+	_, err := proto.ReadExpectedFrame(client, proto.OpcodeFileSendResponse)
+	var relayErr *proto.ErrorPayload
+	if !errors.As(err, &relayErr) || relayErr.Code != proto.ErrShuttingDown {
+		t.Fatalf("late sender was told %v, want relay shutting down", err)
+	}
+	select {
+	case <-shut:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown is stuck waiting on the late sender")
+	}
+	sendersMu.Lock()
+	_, exists := senders["late"]
+	sendersMu.Unlock()
+	if exists {
+		t.Error("late sender is still registered")
+	}
+}
+
+func TestSenderAborted(t *testing.T) {
+	setGlobal(t, &handshakeTimeout, 5*time.Second)
+	for _, receivers := range []int{1, 3} {
+		ctx, cancel := context.WithCancel(context.Background())
+		client, conn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handleSender(ctx, conn, proto.FileSendRequestPayload{Channel: "aborted", Receivers: receivers}, nil, openAccess)
+		}()
+		if _, err := proto.ReadExpectedFrame(client, proto.OpcodeFileSendResponse); err != nil {
+			t.Fatal(err)
+		}
+
+		// Transfers are aborted while the sender is waiting for receivers
+		cancel()
+		expectShuttingDown(t, client)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("sender for %d receivers is still waiting after the abort", receivers)
+		}
+		sendersMu.Lock()
+		_, exists := senders["aborted"]
+		sendersMu.Unlock()
+		if exists {
+			t.Errorf("aborted sender for %d receivers is still registered", receivers)
+		}
+		client.Close()
+		conn.Close()
+	}
+}
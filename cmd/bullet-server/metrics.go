@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics served in Prometheus' text exposition format on -metrics-addr.
+// Only the few metric types we need are implemented here, so that the
+// relay doesn't need any dependency for it.
+var (
+	activeConns        atomic.Int64
+	transfersStarted   atomic.Int64
+	transfersCompleted atomic.Int64
+	transfersFailed    atomic.Int64 // includes ones aborted during shutdown
+	bytesToRecver      atomic.Int64
+	bytesToSender      atomic.Int64
+	failedLookups      atomic.Int64
+	bans               atomic.Int64
+	invalidatedCodes   atomic.Int64
+	storedDownloads    atomic.Int64
+
+	handshakeFailures = newCounterVec(
+		reasonTimeout,
+		reasonDisconnected,
+		reasonBadRequest,
+		reasonVersionMismatch,
+		reasonShuttingDown,
+		reasonTLS,
+		reasonUnauthorized,
+		reasonForbidden,
+		reasonBanned,
+	)
+
+	// Buckets in seconds, from quick transfers to long ones of huge files
+	transferDuration = newHistogram(1, 5, 15, 60, 300, 900, 3600)
+)
+
+// Reasons for failed handshakes
+const (
+	reasonTimeout         = "timeout"
+	reasonDisconnected    = "disconnected"
+	reasonBadRequest      = "bad_request"
+	reasonVersionMismatch = "version_mismatch"
+	reasonShuttingDown    = "shutting_down"
+	reasonTLS             = "tls"
+	reasonUnauthorized    = "unauthorized" // missing or unknown API token
+	reasonForbidden       = "forbidden"    // API token doesn't allow the request
+	reasonBanned          = "banned"       // too many failed share code lookups
+)
+
+// Counters partitioned by a label, all label values are known upfront
+// so that they're reported even when zero
+type counterVec struct {
+	counts map[string]*atomic.Int64
+	order  []string
+}
+
+func newCounterVec(values ...string) *counterVec {
+	cv := &counterVec{counts: make(map[string]*atomic.Int64), order: values}
+	for _, v := range values {
+		cv.counts[v] = new(atomic.Int64)
+	}
+	return cv
+}
+
+func (cv *counterVec) inc(value string) {
+	cv.counts[value].Add(1)
+}
+
+// Cumulative histogram of observed values
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64 // upper bounds of buckets, excluding +Inf
+	buckets []int64   // counts of values <= the matching bound
+	count   int64
+	sum     float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Serves metrics on addr, meant to run in its own goroutine
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+	log.Printf("Serving metrics on http://%s/metrics\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Error serving metrics: %v\n", err)
+	}
+}
+
+func writeMetrics(w io.Writer) {
+	sendersMu.Lock()
+	waiting := len(senders)
+	stored, storedSize := len(uploads), storedBytes
+	sendersMu.Unlock()
+
+	writeMetric(w, "bullet_active_connections", "gauge", "Client connections currently open.", activeConns.Load())
+	writeMetric(w, "bullet_waiting_senders", "gauge", "Senders waiting for a receiver to show up.", int64(waiting))
+	writeMetric(w, "bullet_transfers_started_total", "counter", "Transfers started after pairing a sender with a receiver.", transfersStarted.Load())
+	writeMetric(w, "bullet_transfers_completed_total", "counter", "Transfers where both peers hung up cleanly.", transfersCompleted.Load())
+	writeMetric(w, "bullet_transfers_failed_total", "counter", "Transfers cut short by an error, idle timeout or shutdown.", transfersFailed.Load())
+	writeMetric(w, "bullet_failed_lookups_total", "counter", "Receivers asking for a share code channel nobody is sending on.", failedLookups.Load())
+	writeMetric(w, "bullet_bans_total", "counter", "IPs banned for too many failed share code lookups.", bans.Load())
+	writeMetric(w, "bullet_invalidated_share_codes_total", "counter", "Fan-out share codes invalidated after too many receivers had a different one.", invalidatedCodes.Load())
+	writeMetric(w, "bullet_stored_uploads", "gauge", "Uploads kept in storage for receivers, including ones still being uploaded.", int64(stored))
+	writeMetric(w, "bullet_stored_bytes", "gauge", "Bytes uploads take in storage, including space reserved for ones still being uploaded.", storedSize)
+	writeMetric(w, "bullet_stored_downloads_total", "counter", "Uploads fetched from storage and verified by receivers.", storedDownloads.Load())
+
+	fmt.Fprintf(w, "# HELP bullet_relayed_bytes_total Bytes piped between paired peers.\n")
+	fmt.Fprintf(w, "# TYPE bullet_relayed_bytes_total counter\n")
+	fmt.Fprintf(w, "bullet_relayed_bytes_total{direction=\"to_receiver\"} %d\n", bytesToRecver.Load())
+	fmt.Fprintf(w, "bullet_relayed_bytes_total{direction=\"to_sender\"} %d\n", bytesToSender.Load())
+
+	fmt.Fprintf(w, "# HELP bullet_handshake_failures_total Connections dropped before making a send or recv request.\n")
+	fmt.Fprintf(w, "# TYPE bullet_handshake_failures_total counter\n")
+	for _, reason := range handshakeFailures.order {
+		fmt.Fprintf(w, "bullet_handshake_failures_total{reason=%q} %d\n", reason, handshakeFailures.counts[reason].Load())
+	}
+
+	h := transferDuration
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP bullet_transfer_duration_seconds Time from pairing until a transfer ended.\n")
+	fmt.Fprintf(w, "# TYPE bullet_transfer_duration_seconds histogram\n")
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "bullet_transfer_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+	}
+	fmt.Fprintf(w, "bullet_transfer_duration_seconds_bucket{le=\"+Inf\"} %d\n", h.count)
+	fmt.Fprintf(w, "bullet_transfer_duration_seconds_sum %g\n", h.sum)
+	fmt.Fprintf(w, "bullet_transfer_duration_seconds_count %d\n", h.count)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/diwasrimal/bullet/pkg/proto"
+	"github.com/diwasrimal/bullet/pkg/ratelimit"
+	"github.com/diwasrimal/bullet/pkg/utils"
+)
+
+// Store-and-forward, for senders that upload to the relay and go away
+// instead of waiting for a receiver. Each upload is kept in storeDir as
+// ID.upload holding the encrypted stream, and ID.json holding its details
+// so that it survives restarts. Disabled if storeDir is empty.
+var (
+	storeDir       string
+	storeQuota     sizeFlag      // bytes all uploads may take together, 0 for no limit
+	storeTTL       time.Duration // longest uploads are kept, senders can ask for less
+	storeDownloads int           // uploads are deleted after this many downloads
+)
+
+// An upload kept in storeDir. Uploads share channels with senders,
+// so they're guarded by sendersMu as well.
+type upload struct {
+	ID         string    `json:"id"`
+	Channel    string    `json:"channel"`
+	Size       int64     `json:"size"` // bytes on disk
+	Salt       []byte    `json:"salt"`
+	AccessHash []byte    `json:"access_hash"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Downloads  int       `json:"downloads"` // left before it's deleted
+
+	complete bool // whole upload is on disk, receivers can fetch it
+	fetching int  // downloads in progress
+}
+
+// Uploads mapped by their channels, and bytes they take in storeDir
+// including space reserved for ones in progress
+var uploads = make(map[string]*upload)
+var storedBytes int64
+
+// Byte count flag taking sizes like 10GB
+type sizeFlag int64
+
+func (s sizeFlag) String() string {
+	if s <= 0 {
+		return "0"
+	}
+	return utils.ReadableSize(int64(s))
+}
+
+func (s *sizeFlag) Set(v string) error {
+	n, err := utils.ParseSize(v)
+	if err != nil {
+		return err
+	}
+	*s = sizeFlag(n)
+	return nil
+}
+
+func (u *upload) dataPath() string {
+	return filepath.Join(storeDir, u.ID+".upload")
+}
+
+func (u *upload) infoPath() string {
+	return filepath.Join(storeDir, u.ID+".json")
+}
+
+// Writes details of u next to its data, replacing them whole
+func (u *upload) save() error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := u.infoPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.infoPath())
+}
+
+// Deletes u, must be called with sendersMu held
+func (u *upload) remove() {
+	if uploads[u.Channel] == u {
+		delete(uploads, u.Channel)
+	}
+	storedBytes -= u.Size
+	os.Remove(u.infoPath())
+	os.Remove(u.dataPath())
+}
+
+// Picks up uploads kept in storeDir before a restart, deleting ones that
+// expired meanwhile and leftovers of uploads that never completed
+func loadUploads(now time.Time) error {
+	if err := os.MkdirAll(storeDir, 0700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(storeDir)
+	if err != nil {
+		return err
+	}
+	kept := make(map[string]bool)
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		var u upload
+		data, err := os.ReadFile(filepath.Join(storeDir, entry.Name()))
+		if err == nil {
+			err = json.Unmarshal(data, &u)
+		}
+		if err != nil || u.ID+".json" != entry.Name() {
+			log.Printf("Skipping unreadable upload details %q: %v\n", entry.Name(), err)
+			continue
+		}
+		info, err := os.Stat(u.dataPath())
+		if err != nil || info.Size() != u.Size || !now.Before(u.ExpiresAt) || u.Downloads <= 0 {
+			continue
+		}
+		u.complete = true
+		uploads[u.Channel] = &u
+		storedBytes += u.Size
+		kept[u.ID] = true
+	}
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		if !kept[id] {
+			os.Remove(filepath.Join(storeDir, entry.Name()))
+		}
+	}
+	return nil
+}
+
+// Deletes uploads that have expired, must be called with sendersMu held
+func reapExpiredUploads(now time.Time) {
+	for channel, u := range uploads {
+		if u.complete && u.fetching == 0 && !now.Before(u.ExpiresAt) {
+			log.Printf("upload expired, channel=%q\n", channel)
+			u.remove()
+		}
+	}
+}
+
+// Receives an upload from a sender into storeDir, and lets them know once
+// it's all there. Its channel is reserved right away, but receivers only
+// get it once it's complete.
+func handleStore(ctx context.Context, conn net.Conn, req proto.StoreRequestPayload, access access) {
+	if len(req.Salt) < 16 || len(req.AccessHash) != sha256.Size {
+		handshakeFailures.inc(reasonBadRequest)
+		writeErrorWithLog(conn, proto.ErrBadRequest, "store request needs a salt of at least 16 bytes and a SHA-256 access hash")
+		return
+	}
+	id, err := randomID()
+	if err != nil {
+		writeErrorWithLog(conn, proto.ErrInternal, "generating upload ID: %v", err)
+		return
+	}
+	ttl := storeTTL
+	if req.TTL > 0 {
+		ttl = min(time.Duration(req.TTL)*time.Second, storeTTL)
+	}
+
+	channel := strings.ToLower(req.Channel)
+	sendersMu.Lock()
+	if channel == "" {
+		channel = allocChannel()
+	} else if channelInUse(channel) {
+		sendersMu.Unlock()
+		writeErrorWithLog(conn, proto.ErrShareCodeNotAvailable, "share code channel %q is already in use", channel)
+		return
+	}
+	if storeQuota > 0 && storedBytes+req.Size > int64(storeQuota) {
+		sendersMu.Unlock()
+		writeErrorWithLog(conn, proto.ErrStoreFull, "relay doesn't have room for %s more", utils.ReadableSize(req.Size))
+		return
+	}
+	u := &upload{
+		ID:         id,
+		Channel:    channel,
+		Salt:       req.Salt,
+		AccessHash: req.AccessHash,
+		Downloads:  storeDownloads,
+	}
+	uploads[channel] = u
+	reserved := req.Size
+	storedBytes += reserved
+	sendersMu.Unlock()
+
+	// Whatever goes wrong, don't leave a partial upload behind
+	stored := false
+	defer func() {
+		if !stored {
+			sendersMu.Lock()
+			u.Size = reserved
+			u.remove()
+			sendersMu.Unlock()
+		}
+	}()
+	writeFrameWithLog(ctx, conn, proto.OpcodeStoreResponse, proto.JSONToBytes(proto.StoreResponsePayload{
+		Channel: channel,
+	}))
+
+	f, err := os.OpenFile(u.dataPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Printf("Error creating upload: %v\n", err)
+		writeErrorWithLog(conn, proto.ErrInternal, "relay couldn't store the upload")
+		return
+	}
+	written, err := receiveUpload(ctx, conn, f, relayLimit(access, openAccess), func(size int64) bool {
+		// Ask for more room only once the reservation runs out
+		if size <= reserved {
+			return true
+		}
+		sendersMu.Lock()
+		defer sendersMu.Unlock()
+		if storeQuota > 0 && storedBytes+size-reserved > int64(storeQuota) {
+			return false
+		}
+		storedBytes += size - reserved
+		reserved = size
+		return true
+	})
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	var relayErr *proto.ErrorPayload
+	switch {
+	case errors.As(err, &relayErr):
+		writeErrorWithLog(conn, relayErr.Code, "%s", relayErr.Message)
+		return
+	case err != nil:
+		log.Printf("Upload failed, conn=%s err=%v\n", conn.RemoteAddr().String(), err)
+		return
+	}
+
+	sendersMu.Lock()
+	storedBytes -= reserved - written
+	reserved = written
+	u.Size = written
+	u.ExpiresAt = time.Now().Add(ttl)
+	err = u.save()
+	u.complete = err == nil
+	sendersMu.Unlock()
+	if err != nil {
+		log.Printf("Error saving upload details: %v\n", err)
+		writeErrorWithLog(conn, proto.ErrInternal, "relay couldn't store the upload")
+		return
+	}
+	stored = true
+	log.Printf("Stored upload of %d bytes, channel=%q conn=%s\n", written, channel, conn.RemoteAddr().String())
+	writeFrameWithLog(ctx, conn, proto.OpcodeStored, proto.JSONToBytes(proto.StoredPayload{
+		ExpiresIn: int(ttl / time.Second),
+		Downloads: u.Downloads,
+	}))
+}
+
+// Writes encrypted chunks read from conn to w until the sender marks the
+// end, returning how many bytes were written. The upload is cut off once
+// it goes over limit if it isn't 0, or when room for it can't be made.
+func receiveUpload(ctx context.Context, conn net.Conn, w io.Writer, limit int64, makeRoom func(size int64) bool) (written int64, err error) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	r := ratelimit.NewReader(conn, bandwidth, ratelimit.New(int64(maxTransferRate)))
+	for {
+		if idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+		opcode, payload, err := proto.ReadFrame(r)
+		if err != nil {
+			return written, err
+		}
+		switch opcode {
+		case proto.OpcodeDataEnd:
+			return written, nil
+		case proto.OpcodeEncryptedChunk:
+		default:
+			return written, &proto.ErrorPayload{Code: proto.ErrBadRequest, Message: fmt.Sprintf("unexpected %s in upload", opcode)}
+		}
+		n, err := proto.WriteFrame(w, opcode, payload)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if limit > 0 && written > limit {
+			return written, &proto.ErrorPayload{Code: proto.ErrTooLarge, Message: "upload is over the size API token allows"}
+		}
+		if !makeRoom(written) {
+			return written, &proto.ErrorPayload{Code: proto.ErrStoreFull, Message: "relay ran out of room for the upload"}
+		}
+	}
+}
+
+// Hands an upload to a receiver who proves they know its share code, and
+// counts the download once they confirm getting all of it. Receivers that
+// show up while it's still being uploaded are told to come back later.
+func handleFetch(ctx context.Context, conn net.Conn, u *upload, capabilities []string) {
+	if !slices.Contains(capabilities, proto.CapStore) {
+		writeErrorWithLog(conn, proto.ErrBadRequest, "share code is for a stored upload, which needs a newer bullet to receive")
+		return
+	}
+	hctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	writeFrameWithLog(hctx, conn, proto.OpcodeStoredFile, proto.JSONToBytes(proto.StoredFilePayload{
+		Salt: u.Salt,
+	}))
+	payload, err := proto.ReadExpectedFrameContext(hctx, conn, proto.OpcodeFetchRequest)
+	if err != nil {
+		handshakeFailed(conn, err)
+		return
+	}
+	req, err := proto.ParseJSON[proto.FetchRequestPayload](payload)
+	if err != nil {
+		writeErrorWithLog(conn, proto.ErrBadRequest, "malformed fetch request: %v", err)
+		return
+	}
+	// Someone guessing the channel doesn't get to use up downloads
+	accessHash := sha256.Sum256(req.Access)
+	if subtle.ConstantTimeCompare(accessHash[:], u.AccessHash) != 1 {
+		lookupFailed(clientIP(conn), time.Now())
+		writeErrorWithLog(conn, proto.ErrShareCodeNotFound, "no upload matches the share code")
+		return
+	}
+
+	sendersMu.Lock()
+	complete := u.complete
+	available := complete && uploads[u.Channel] == u && u.Downloads-u.fetching > 0
+	if available {
+		u.fetching++
+	}
+	sendersMu.Unlock()
+	if !complete {
+		writeErrorWithLog(conn, proto.ErrUploadInProgress, "upload isn't finished yet, try again once the sender is done")
+		return
+	}
+	if !available {
+		writeErrorWithLog(conn, proto.ErrShareCodeNotFound, "upload was already downloaded")
+		return
+	}
+
+	done := false
+	defer func() {
+		sendersMu.Lock()
+		defer sendersMu.Unlock()
+		u.fetching--
+		if !done {
+			return
+		}
+		u.Downloads--
+		storedDownloads.Add(1)
+		if u.Downloads <= 0 {
+			log.Printf("upload downloaded, channel=%q\n", u.Channel)
+			u.remove()
+		} else if err := u.save(); err != nil {
+			log.Printf("Error saving upload details: %v\n", err)
+		}
+	}()
+
+	f, err := os.Open(u.dataPath())
+	if err != nil {
+		log.Printf("Error opening upload: %v\n", err)
+		writeErrorWithLog(conn, proto.ErrInternal, "relay couldn't read the upload")
+		return
+	}
+	defer f.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	touch := func() {
+		if idleTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(idleTimeout))
+		}
+	}
+	touch()
+	src := ratelimit.NewReader(activityReader{f, &bytesToRecver, touch}, bandwidth, ratelimit.New(int64(maxTransferRate)))
+	if _, err := io.Copy(conn, src); err != nil {
+		log.Printf("Download failed, conn=%s err=%v\n", conn.RemoteAddr().String(), err)
+		return
+	}
+	touch()
+	if _, err := proto.ReadExpectedFrame(conn, proto.OpcodeFetchDone); err != nil {
+		log.Printf("Receiver didn't confirm download, conn=%s err=%v\n", conn.RemoteAddr().String(), err)
+		return
+	}
+	done = true
+}
+
+// Whether channel is taken by a sender or an upload,
+// must be called with sendersMu held
+func channelInUse(channel string) bool {
+	_, sending := senders[channel]
+	_, stored := uploads[channel]
+	return sending || stored
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/diwasrimal/bullet/pkg/proto"
+)
+
+func TestFetchUnfinishedUpload(t *testing.T) {
+	setGlobal(t, &handshakeTimeout, 5*time.Second)
+	setGlobal(t, &lookupBurst, 3)
+	setGlobal(t, &lookupBuckets, make(map[string]*lookupBucket))
+	access := []byte("access")
+	accessHash := sha256.Sum256(access)
+	u := &upload{
+		ID:         "unfinished",
+		Channel:    "test-unfinished",
+		Salt:       make([]byte, 16),
+		AccessHash: accessHash[:],
+		Downloads:  1,
+	}
+	setGlobal(t, &uploads, map[string]*upload{u.Channel: u})
+
+	for _, c := range []struct {
+		access     []byte
+		want       proto.ErrorCode
+		wantLookup bool
+	}{
+		{access, proto.ErrUploadInProgress, false},
+		{[]byte("guess"), proto.ErrShareCodeNotFound, true},
+	} {
+		client, conn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer conn.Close()
+			req := proto.FileRecvRequestPayload{Channel: u.Channel}
+			handleRecver(context.Background(), conn, req, []string{proto.CapStore}, openAccess)
+		}()
+		if _, err := proto.ReadExpectedFrame(client, proto.OpcodeStoredFile); err != nil {
+			t.Fatal(err)
+		}
+		proto.WriteFrame(client, proto.OpcodeFetchRequest, proto.JSONToBytes(proto.FetchRequestPayload{
+			Access: c.access,
+		}))
+		_, err := proto.ReadExpectedFrame(client, proto.OpcodeEncryptedChunk)
+		var relayErr *proto.ErrorPayload
+		if !errors.As(err, &relayErr) || relayErr.Code != c.want {
+			t.Errorf("access %q: receiver was told %v, want %s", c.access, err, c.want)
+		}
+		<-done
+		client.Close()
+		if _, counted := lookupBuckets["pipe"]; counted != c.wantLookup {
+			t.Errorf("access %q: counted as a failed lookup: %v, want %v", c.access, counted, c.wantLookup)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Certificate and key files to serve TLS with, or a self-signed
+// certificate generated on startup for development
+var (
+	tlsCertFile   string
+	tlsKeyFile    string
+	tlsSelfSigned bool
+)
+
+// Returns the TLS config to serve clients with, nil if TLS isn't enabled
+func loadTLSConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case tlsCertFile != "" || tlsKeyFile != "":
+		if tlsCertFile == "" || tlsKeyFile == "" {
+			return nil, errors.New("both -tls-cert and -tls-key are needed")
+		}
+		cert, err = tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	case tlsSelfSigned:
+		cert, err = selfSignedCert()
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Generates a certificate for localhost that's only good for development,
+// clients have to pin its fingerprint since no CA vouches for it
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "bullet-server"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Hex encoded SHA-256 of the certificate, which clients can pin
+func fingerprint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
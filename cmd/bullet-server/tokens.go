@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// What a client presenting an API token may do. The tokens file
+// holds a JSON array of these, like
+//
+//	[{"token": "3f9a...", "name": "ci", "send": true, "max_file_size": 1073741824}]
+type access struct {
+	Token       string `json:"token"`
+	Name        string `json:"name"` // who the token was given to, for logs
+	Send        bool   `json:"send"`
+	Recv        bool   `json:"recv"`
+	MaxFileSize int64  `json:"max_file_size,omitempty"` // bytes, 0 for no limit
+}
+
+// Access of clients when the relay is open to anyone
+var openAccess = access{Name: "anyone", Send: true, Recv: true}
+
+// API tokens clients must present, mapped by the token.
+// Nil if the relay is open to anyone.
+var tokens map[string]access
+
+// File to load tokens from, see access
+var tokensFile string
+
+func loadTokens(path string) (map[string]access, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []access
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", path, err)
+	}
+	tokens := make(map[string]access, len(list))
+	for i, a := range list {
+		if a.Token == "" {
+			return nil, fmt.Errorf("token %d in %q is empty", i+1, path)
+		}
+		if _, exists := tokens[a.Token]; exists {
+			return nil, fmt.Errorf("token %d in %q is listed twice", i+1, path)
+		}
+		if a.MaxFileSize < 0 {
+			return nil, fmt.Errorf("token %d in %q has a negative max_file_size", i+1, path)
+		}
+		tokens[a.Token] = a
+	}
+	return tokens, nil
+}
+
+// Looks up what a client presenting token may do
+func authorize(token string) (access, error) {
+	if tokens == nil {
+		return openAccess, nil
+	}
+	if token == "" {
+		return access{}, errors.New("this relay needs an API token")
+	}
+	a, ok := tokens[token]
+	if !ok {
+		return access{}, errors.New("unknown API token")
+	}
+	return a, nil
+}
+
+// Whether a file of size bytes is over the limit of a
+func (a access) tooLarge(size int64) bool {
+	return a.MaxFileSize > 0 && size > a.MaxFileSize
+}
+
+// Most bytes to relay from sender to receiver, given their access, or 0
+// for no limit. There's room for encryption and framing overhead on top
+// of the file size limit, since the data we relay is opaque to us.
+func relayLimit(senderAccess, recverAccess access) int64 {
+	limit := senderAccess.MaxFileSize
+	if recverAccess.MaxFileSize > 0 && (limit == 0 || recverAccess.MaxFileSize < limit) {
+		limit = recverAccess.MaxFileSize
+	}
+	if limit == 0 {
+		return 0
+	}
+	return limit + limit/64 + 1<<20
+}
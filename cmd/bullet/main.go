@@ -2,12 +2,21 @@ package main
 
 import (
 	"os"
+	"time"
 )
 
 const debugEnabled = false
 
 var defaultRelayAddr = "0.0.0.0:3030"
 
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultIdleTimeout      = time.Minute
+)
+
+// Most words -words can ask for, 80 bits is plenty
+const maxCodeWords = 8
+
 const usage = `Usage: %[1]s COMMAND
 
 Commands:
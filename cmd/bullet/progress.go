@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/diwasrimal/bullet/pkg/utils"
+)
+
+// Ways of showing progress, picked with -progress
+const (
+	progressAuto = "auto" // bar if stderr is a terminal, nothing otherwise
+	progressBar  = "bar"
+	progressJSON = "json" // a line of JSON every second, for scripts
+	progressNone = "none"
+)
+
+var progressModes = []string{progressAuto, progressBar, progressJSON, progressNone}
+
+const (
+	barInterval  = 200 * time.Millisecond
+	jsonInterval = time.Second
+	barWidth     = 24
+)
+
+// Shows progress of a transfer on stderr, fed by client.Options.Progress
+type progress struct {
+	mode     string
+	interval time.Duration
+
+	start     time.Time // when data started moving
+	startDone int64     // bytes skipped due to resuming, not part of throughput
+	last      time.Time // when progress was last shown
+	lastDone  int64
+	rate      float64 // bytes per second, smoothed over recent intervals
+	done      int64
+	total     int64
+}
+
+// Line printed in json mode. Percent and ETA are left out if the size isn't known.
+type progressLine struct {
+	Done    int64    `json:"done"`
+	Total   int64    `json:"total"`             // -1 if not known
+	Percent *float64 `json:"percent,omitempty"` // of total
+	Rate    float64  `json:"rate"`              // bytes per second, recently
+	AvgRate float64  `json:"avg_rate"`          // bytes per second, since the start
+	Elapsed float64  `json:"elapsed"`           // seconds
+	ETA     *float64 `json:"eta,omitempty"`     // seconds
+}
+
+// Returns nil if progress shouldn't be shown in mode
+func newProgress(mode string) *progress {
+	if mode == progressAuto {
+		mode = ifelse(stderrIsTerminal(), progressBar, progressNone)
+	}
+	switch mode {
+	case progressBar:
+		return &progress{mode: mode, interval: barInterval}
+	case progressJSON:
+		return &progress{mode: mode, interval: jsonInterval}
+	default:
+		return nil
+	}
+}
+
+func stderrIsTerminal() bool {
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Records that done bytes out of total have been transferred, and shows
+// it if it's been a while. Meant to be used as client.Options.Progress.
+func (p *progress) update(done, total int64) {
+	now := time.Now()
+	p.done, p.total = done, total
+	if p.start.IsZero() {
+		p.start, p.startDone = now, done
+		p.last, p.lastDone = now, done
+		return
+	}
+	elapsed := now.Sub(p.last)
+	if elapsed < p.interval {
+		return
+	}
+	current := float64(done-p.lastDone) / elapsed.Seconds()
+	if p.rate == 0 {
+		p.rate = current
+	} else {
+		p.rate = 0.7*p.rate + 0.3*current
+	}
+	p.last, p.lastDone = now, done
+	p.show(now)
+}
+
+// Shows the final progress, must be called before printing anything
+// else once the transfer is over
+func (p *progress) finish() {
+	if p == nil || p.start.IsZero() {
+		return
+	}
+	p.show(time.Now())
+	if p.mode == progressBar {
+		eprintf("\n")
+	}
+}
+
+func (p *progress) show(now time.Time) {
+	elapsed := now.Sub(p.start)
+	var avgRate float64
+	if elapsed > 0 {
+		avgRate = float64(p.done-p.startDone) / elapsed.Seconds()
+	}
+	var percent, eta *float64
+	if p.total > 0 {
+		percent = new(float64)
+		*percent = 100 * float64(p.done) / float64(p.total)
+		if p.rate > 0 {
+			eta = new(float64)
+			*eta = float64(p.total-p.done) / p.rate
+		}
+	}
+
+	if p.mode == progressJSON {
+		line, _ := json.Marshal(progressLine{
+			Done:    p.done,
+			Total:   p.total,
+			Percent: percent,
+			Rate:    p.rate,
+			AvgRate: avgRate,
+			Elapsed: elapsed.Seconds(),
+			ETA:     eta,
+		})
+		eprintf("%s\n", line)
+		return
+	}
+
+	// Redraw the bar in place, clearing whatever was left of the last one
+	var b strings.Builder
+	b.WriteString("\r")
+	if percent != nil {
+		filled := min(int(*percent/100*barWidth), barWidth)
+		fmt.Fprintf(&b, "[%s%s] %5.1f%% ", strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), *percent)
+		fmt.Fprintf(&b, "%s/%s", utils.ReadableSize(p.done), utils.ReadableSize(p.total))
+	} else {
+		b.WriteString(utils.ReadableSize(p.done))
+	}
+	fmt.Fprintf(&b, "  %s/s (avg %s/s)", utils.ReadableSize(int64(p.rate)), utils.ReadableSize(int64(avgRate)))
+	if eta != nil {
+		fmt.Fprintf(&b, "  ETA %s", shortDuration(time.Duration(*eta*float64(time.Second))))
+	}
+	b.WriteString("\x1b[K")
+	eprintf("%s", b.String())
+}
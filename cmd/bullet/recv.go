@@ -1,122 +1,350 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"net"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/diwasrimal/bullet/pkg/client"
 	"github.com/diwasrimal/bullet/pkg/proto"
+	"github.com/diwasrimal/bullet/pkg/ratelimit"
+	"github.com/diwasrimal/bullet/pkg/utils"
+	"github.com/diwasrimal/bullet/pkg/wordcode"
 )
 
 type recvCmdOpts struct {
 	flags struct {
-		relayAddr   string
-		outFilepath string
+		relayAddr        string
+		outFilepath      string
+		handshakeTimeout time.Duration
+		idleTimeout      time.Duration
+		noDirect         bool
+		progress         string
+		lan              bool
+		relayTLS         relayTLSFlags
+		only             string
+		yes              bool
+		limit            ratelimit.Rate
 	}
 	args struct {
 		shareCode string
 	}
-}
 
-func recv(opts recvCmdOpts) {
-	// Create a TCP connection and perform handshake
-	conn, err := net.Dial("tcp", opts.flags.relayAddr)
-	if err != nil {
-		eprintf("Error connecting with server: %v\n", err)
-		return
-	}
-	defer conn.Close()
+	relayTLS *tls.Config // built from flags.relayTLS
+	token    string      // API token for the relay
+}
 
-	// Perform handshake with server
-	_, err = proto.WriteFrame(conn, proto.OpcodeHandshakeRequest, nil)
-	if err != nil {
-		eprintf("Error during handshake: %v\n", err)
-		return
-	}
-	opcode, _, err := proto.ReadFrame(conn)
-	if err != nil {
-		eprintf("Error reading handshake resposne: %v\n", err)
-		return
-	}
-	if opcode != proto.OpcodeHandshakeResponse {
-		eprintf("Couldn't complete handshake\n")
-		return
-	}
+var errDeclined = errors.New("declined")
 
-	// Do file recv request
-	_, err = proto.WriteFrame(
-		conn,
-		proto.OpcodeFileRecvRequest,
-		proto.JSONToBytes(proto.FileRecvRequestPayload{
-			ShareCode: opts.args.shareCode,
-		}),
+func recv(opts recvCmdOpts) {
+	var (
+		outFilepath string   // where data ends up
+		dstfile     *os.File // nil when writing to stdout
+		dirExists   bool     // folder was already there before receiving
+		picked      []string // names of files received when sender offers several
 	)
-	if err != nil {
-		eprintf("Error during recv file request: %v\n", err)
-		return
-	}
-	opcode, payload, err := proto.ReadFrame(conn)
-	if opcode != proto.OpcodeFileRecvResponse {
-		if opcode == proto.OpcodeShareCodeNotFound {
-			eprintf("Share code %q not found!\n", opts.args.shareCode)
-		} else {
-			eprintf("Unexpected opcode, have (%d) want (%d), closing connection....\n", opcode, proto.OpcodeFileRecvResponse)
-		}
-		return
-	}
-	fileRecvResp := proto.DecodeJSON[proto.FileRecvResponsePayload](payload)
-	eprintf("Detected sender's file: %q (%s)\n", fileRecvResp.Filename, readableSize(fileRecvResp.Filesize))
 
 	// Determine output file path
 	// If filepath is provided by user though the cli, we'll write data there,
-	// else we'll use the receiving file's name
+	// else we'll use the receiving file's name, stripped of any directories
 	// If "-" is provided, we write to stdout
-	outFilepath := fileRecvResp.Filename
-	if opts.flags.outFilepath != "" {
-		outFilepath = opts.flags.outFilepath
+	outPath := func(meta client.Meta) string {
+		if opts.flags.outFilepath != "" {
+			return opts.flags.outFilepath
+		}
+		return safeFilename(meta.Name)
 	}
 
-	var dstfile *os.File
-	if outFilepath == "-" {
-		dstfile = os.Stdout
-	} else {
-		// Get confirmation to overwrite
-		_, err = os.Stat(outFilepath)
+	// Prompts are answered by Ctrl-C too, which cancels the transfer
+	ctx, stop := interruptContext()
+	defer stop()
+
+	// Asks a question defaulting to yes, -y answers it without asking
+	confirm := func(format string, a ...any) (bool, error) {
+		if opts.flags.yes {
+			return true, nil
+		}
+		resp, err := ask(ctx, format+" (Y/n): ", a...)
+		return resp != "n", err
+	}
+
+	accept := func(meta client.Meta) (io.Writer, error) {
+		eprintf("Detected sender's file: %q (%s)\n", meta.Name, readableSize(meta.Size))
+		if ok, err := confirm("Receive it?"); !ok || err != nil {
+			return nil, cmp.Or(err, errDeclined)
+		}
+		outFilepath = outPath(meta)
+		if outFilepath == "-" {
+			return struct{ io.Writer }{os.Stdout}, nil // hide Seek, stdout can't be resumed
+		}
+
+		// A smaller file with the same name is likely a partially received
+		// file from an earlier attempt, so offer to resume it.
+		// Otherwise get confirmation to overwrite
+		info, err := os.Stat(outFilepath)
 		fileExists := !errors.Is(err, os.ErrNotExist) // TODO: maybe just err == nil is enough
-		if fileExists {
-			eprintf("%q already exists, overwrite? (Y/n): ", outFilepath)
-			var resp string
-			fmt.Scanln(&resp)
-			if resp == "n" {
-				eprintf("Closing connection...\n")
-				return
+		resume := false
+		if err == nil && info.Mode().IsRegular() && info.Size() > 0 && info.Size() < meta.Size {
+			resume, err = confirm("%q is partially received (%s/%s), resume?", outFilepath, utils.ReadableSize(info.Size()), utils.ReadableSize(meta.Size))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if fileExists && !resume {
+			if ok, err := confirm("%q already exists, overwrite?", outFilepath); !ok || err != nil {
+				return nil, cmp.Or(err, errDeclined)
 			}
 		}
-		dstfile, err = os.Create(outFilepath)
+
+		// Client resumes from files opened for reading and
+		// writing, and starts over if they don't match
+		if resume {
+			dstfile, err = os.OpenFile(outFilepath, os.O_RDWR, 0)
+		} else {
+			dstfile, err = os.Create(outFilepath)
+		}
 		if err != nil {
-			eprintf("Error opening %q for writing: %s\n", outFilepath, err)
-			return
+			return nil, fmt.Errorf("opening %q for writing: %w", outFilepath, err)
 		}
+		return dstfile, nil
 	}
 
-	// Now notify server that we are ready to receive the file
-	// And receive the file into destination
-	proto.WriteFrame(conn, proto.OpcodeReadyToRecieve, nil)
-	nc, err := io.CopyN(dstfile, conn, fileRecvResp.Filesize)
-	if err != nil {
+	clientOpts := client.Options{
+		Logf:             eprintf,
+		HandshakeTimeout: opts.flags.handshakeTimeout,
+		IdleTimeout:      opts.flags.idleTimeout,
+		NoDirect:         opts.flags.noDirect,
+		LAN:              opts.flags.lan,
+		TLS:              opts.relayTLS,
+		Token:            opts.token,
+		RateLimit:        int64(opts.flags.limit),
+		AcceptFolder: func(meta client.Meta) (string, error) {
+			eprintf("Detected sender's folder: %q (%d files, %s)\n", meta.Name, meta.Files, utils.ReadableSize(meta.Size))
+			if ok, err := confirm("Receive it?"); !ok || err != nil {
+				return "", cmp.Or(err, errDeclined)
+			}
+			outFilepath = outPath(meta)
+			if outFilepath == "-" {
+				return "", errors.New("can't write a folder to stdout")
+			}
+			_, err := os.Stat(outFilepath)
+			dirExists = err == nil
+			if dirExists {
+				if ok, err := confirm("%q already exists, write into it?", outFilepath); !ok || err != nil {
+					return "", cmp.Or(err, errDeclined)
+				}
+			}
+			return outFilepath, nil
+		},
+		AcceptFiles: func(meta client.Meta) (string, []int, error) {
+			eprintf("Detected sender's files (%d files, %s):\n", meta.Files, utils.ReadableSize(meta.Size))
+			for i, file := range meta.Manifest {
+				eprintf("%3d. %s (%s)\n", i+1, file.Name, utils.ReadableSize(file.Size))
+			}
+			outFilepath = cmp.Or(opts.flags.outFilepath, ".")
+			if outFilepath == "-" {
+				return "", nil, errors.New("can't write several files to stdout")
+			}
+
+			// Pick files with -only if given, otherwise ask which ones
+			var selected []int
+			switch {
+			case opts.flags.only != "":
+				selected = matchFiles(meta.Manifest, strings.Split(opts.flags.only, ","))
+				if len(selected) == 0 {
+					return "", nil, fmt.Errorf("no files match -only %q", opts.flags.only)
+				}
+			case opts.flags.yes:
+				selected, _ = parseSelection("", len(meta.Manifest))
+			default:
+				for {
+					resp, err := ask(ctx, "Receive which files? (Enter for all, numbers like 1,3-4, n to decline): ")
+					if err != nil {
+						return "", nil, err
+					}
+					if resp == "n" {
+						return "", nil, errDeclined
+					}
+					selected, err = parseSelection(resp, len(meta.Manifest))
+					if err == nil {
+						break
+					}
+					eprintf("%v\n", err)
+				}
+			}
+
+			var existing []string
+			for _, i := range selected {
+				name := meta.Manifest[i].Name
+				picked = append(picked, name)
+				if _, err := os.Stat(filepath.Join(outFilepath, name)); err == nil {
+					existing = append(existing, strconv.Quote(name))
+				}
+			}
+			if len(existing) > 0 {
+				if ok, err := confirm("%s already exist in %q, overwrite?", strings.Join(existing, ", "), outFilepath); !ok || err != nil {
+					return "", nil, cmp.Or(err, errDeclined)
+				}
+			}
+			return outFilepath, selected, nil
+		},
+	}
+
+	receive := func(shareCode string) (client.Result, error) {
+		progress := newProgress(opts.flags.progress)
+		if progress != nil {
+			clientOpts.Progress = progress.update
+		}
+		result, err := client.Receive(ctx, opts.flags.relayAddr, shareCode, accept, clientOpts)
+		progress.finish()
+		return result, err
+	}
+	shareCode := proto.NormalizeShareCode(opts.args.shareCode)
+	result, err := receive(shareCode)
+
+	// Word share codes are easy to mistype, so offer to fix likely typos
+	// once the relay doesn't know the share code. A custom share code can
+	// look like a mistyped one too, so the fix is never made without asking.
+	var relayErr *proto.ErrorPayload
+	suggestion := shareCode
+	if errors.As(err, &relayErr) && relayErr.Code == proto.ErrShareCodeNotFound {
+		suggestion = wordcode.Suggest(shareCode)
+	}
+	if suggestion != shareCode && !opts.flags.yes {
+		resp, askErr := ask(ctx, "Share code %q not found, did you mean %s? (Y/n): ", shareCode, suggestion)
+		if askErr != nil {
+			eprintf("Transfer cancelled\n")
+			os.Exit(130)
+		}
+		if resp != "n" {
+			shareCode = suggestion
+			result, err = receive(shareCode)
+		}
+	}
+	if dstfile != nil {
+		dstfile.Close()
+	}
+
+	switch {
+	case err == nil:
+	case errors.Is(err, context.Canceled):
+		eprintf("Transfer cancelled\n")
+		os.Exit(130)
+	case errors.Is(err, proto.ErrCancelled):
+		eprintf("Sender cancelled the transfer\n")
+		return
+	case errors.Is(err, errDeclined):
+		eprintf("Closing connection...\n")
+		return
+	case errors.As(err, &relayErr) && relayErr.Code == proto.ErrShareCodeNotFound:
+		eprintf("Share code %q not found!\n", shareCode)
+		if opts.flags.yes && suggestion != shareCode {
+			eprintf("Did you mean %s?\n", suggestion)
+		}
+		return
+	case errors.As(err, &relayErr) && relayErr.Code == proto.ErrUploadInProgress:
+		eprintf("Sender is still uploading to the relay, try again once they're done\n")
+		return
+	case errors.As(err, &relayErr) && relayErr.Code == proto.ErrUnauthorized:
+		printTokenHelp(relayErr)
+		return
+	case errors.Is(err, client.ErrDigestMismatch):
+		eprintf("Error verifying data: %s\n", err)
+		switch {
+		case result.Meta.Manifest != nil:
+			for _, name := range picked {
+				quarantine(filepath.Join(outFilepath, name))
+			}
+		case result.Meta.IsDir && dirExists:
+			// Can't tell our files apart from ones that were already there
+			eprintf("Contents of %q may be corrupted\n", outFilepath)
+		case dstfile != nil || result.Meta.IsDir:
+			quarantine(outFilepath)
+		}
+		return
+	default:
 		eprintf("Error receiving file: %s\n", err)
 		return
 	}
-	if int64(nc) != fileRecvResp.Filesize {
-		eprintf("Didn't receive whole file, got (%d/%d) bytes\n", nc, fileRecvResp.Filesize)
+
+	if result.Meta.IsDir || result.Meta.Manifest != nil {
+		eprintf("Received %d bytes of data in %d files at %q.\n", result.Transferred, result.Meta.Files, outFilepath)
+	} else {
+		eprintf("Received %d bytes of data at %q.\n", result.Transferred, ifelse(dstfile != nil, outFilepath, os.Stdout.Name()))
+	}
+	if result.SHA256 != "" {
+		eprintf("SHA-256: %s\n", result.SHA256)
+	}
+}
+
+// Moves corrupted data out of the way so that it isn't mistaken for a good copy
+func quarantine(path string) {
+	corrupted := path + ".corrupt"
+	if err := os.Rename(path, corrupted); err != nil {
+		eprintf("Error moving corrupted data, remove %q manually: %s\n", path, err)
 		return
 	}
-	eprintf("Received %d bytes of data at %q.\n", nc, dstfile.Name())
+	eprintf("Moved corrupted data to %q\n", corrupted)
+}
+
+// Returns indices of files with names matching any of the glob patterns
+func matchFiles(manifest []proto.ManifestEntry, patterns []string) []int {
+	var selected []int
+	for i, file := range manifest {
+		if slices.ContainsFunc(patterns, func(pattern string) bool {
+			matched, _ := path.Match(strings.TrimSpace(pattern), file.Name)
+			return matched
+		}) {
+			selected = append(selected, i)
+		}
+	}
+	return selected
+}
 
-	return // -- prev code cut here --
+// Parses files picked by the user, like "1,3-4" with files numbered from 1
+// to n, into sorted indices. Empty picks all of them.
+func parseSelection(s string, n int) ([]int, error) {
+	var selected []int
+	if s == "" || s == "y" || s == "Y" {
+		for i := range n {
+			selected = append(selected, i)
+		}
+		return selected, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err1 := strconv.Atoi(from)
+		last, err2 := strconv.Atoi(ifelse(isRange, to, from))
+		if err1 != nil || err2 != nil || first < 1 || last > n || first > last {
+			return nil, fmt.Errorf("%q isn't a file number or range between 1 and %d", part, n)
+		}
+		for i := first; i <= last; i++ {
+			selected = append(selected, i-1)
+		}
+	}
+	slices.Sort(selected)
+	return slices.Compact(selected), nil
+}
+
+// Strips directories from a filename given by sender,
+// so that it can't be used to write outside current directory
+func safeFilename(name string) string {
+	name = filepath.Base(filepath.Clean("/" + filepath.FromSlash(name)))
+	if name == "/" || name == string(filepath.Separator) || name == "." {
+		return "bullet-download"
+	}
+	return name
 }
 
 func mustParseRecvCmd(args []string) recvCmdOpts {
@@ -124,7 +352,16 @@ func mustParseRecvCmd(args []string) recvCmdOpts {
 
 	cmd := flag.NewFlagSet("recv", flag.ExitOnError)
 	cmd.StringVar(&opts.flags.relayAddr, "relay", "", "Relay server address")
-	cmd.StringVar(&opts.flags.outFilepath, "o", "", "Output file name")
+	cmd.StringVar(&opts.flags.outFilepath, "o", "", "Output file name, or directory when receiving several files")
+	cmd.BoolVar(&opts.flags.yes, "y", false, "Receive without asking, answering yes to every question")
+	cmd.StringVar(&opts.flags.only, "only", "", "When sender offers several files, receive the ones matching these comma separated globs without asking")
+	cmd.DurationVar(&opts.flags.handshakeTimeout, "handshake-timeout", defaultHandshakeTimeout, "Time limit for connecting and getting paired with sender")
+	cmd.DurationVar(&opts.flags.idleTimeout, "idle-timeout", defaultIdleTimeout, "Give up if no data moves for this long during transfer")
+	cmd.BoolVar(&opts.flags.noDirect, "no-direct", false, "Always transfer through the relay, without trying to connect directly")
+	cmd.BoolVar(&opts.flags.lan, "lan", false, "Find the sender on the local network instead of going through a relay")
+	cmd.StringVar(&opts.flags.progress, "progress", progressAuto, "How to show progress: auto (a bar if stderr is a terminal), bar, json or none")
+	cmd.Var(&opts.flags.limit, "limit", "Limit how fast data is received to this `rate`, like 20MB/s (default no limit)")
+	opts.flags.relayTLS.register(cmd)
 	cmd.Usage = func() {
 		eprintf("Usage: %s recv [FLAGS] SHARE_CODE\n\n", os.Args[0])
 		eprintf("FLAGS:\n")
@@ -137,6 +374,21 @@ func mustParseRecvCmd(args []string) recvCmdOpts {
 	if opts.flags.relayAddr == "" {
 		opts.flags.relayAddr = defaultRelayAddr
 	}
+	relayTLS, err := opts.flags.relayTLS.config()
+	if err != nil {
+		eprintf("%v\n", err)
+		os.Exit(1)
+	}
+	opts.relayTLS = relayTLS
+	opts.token, err = relayToken()
+	if err != nil {
+		eprintf("%v\n", err)
+		os.Exit(1)
+	}
+	if !slices.Contains(progressModes, opts.flags.progress) {
+		eprintf("-progress must be one of %s\n", strings.Join(progressModes, ", "))
+		os.Exit(1)
+	}
 	if cmd.NArg() != 1 {
 		cmd.Usage()
 		os.Exit(1)
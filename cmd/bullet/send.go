@@ -1,149 +1,221 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
-	"io"
-	"net"
+	"fmt"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/diwasrimal/bullet/pkg/archive"
+	"github.com/diwasrimal/bullet/pkg/client"
 	"github.com/diwasrimal/bullet/pkg/proto"
+	"github.com/diwasrimal/bullet/pkg/ratelimit"
 	"github.com/diwasrimal/bullet/pkg/utils"
 )
 
 type sendCmdOpts struct {
 	flags struct {
-		shareCode string
-		relayAddr string
+		shareCode        string
+		relayAddr        string
+		ttl              time.Duration
+		handshakeTimeout time.Duration
+		waitTimeout      time.Duration
+		idleTimeout      time.Duration
+		noDirect         bool
+		progress         string
+		lan              bool
+		relayTLS         relayTLSFlags
+		maxReceivers     int
+		name             string
+		compress         string
+		words            int
+		keepWaiting      bool
+		async            bool
+		limit            ratelimit.Rate
 	}
 	args struct {
-		filepath string
+		filepaths []string
 	}
+
+	relayTLS *tls.Config // built from flags.relayTLS
+	token    string      // API token for the relay
 }
 
 func send(opts sendCmdOpts) {
-	// Open file
-	srcfile, err := os.Open(opts.args.filepath)
-	if err != nil {
-		eprintf("Error opening file: %v\n", err)
-		os.Exit(1)
+	// Open file, "-" being stdin. Several files are offered together
+	// and only opened once the receiver picks some of them.
+	srcfile := os.Stdin
+	if len(opts.args.filepaths) > 1 {
+		srcfile = nil
+	} else if opts.args.filepaths[0] != "-" {
+		var err error
+		srcfile, err = os.Open(opts.args.filepaths[0])
+		if err != nil {
+			eprintf("Error opening file: %v\n", err)
+			os.Exit(1)
+		}
+		defer srcfile.Close()
 	}
-	defer srcfile.Close()
-	fileInfo, err := srcfile.Stat()
-	if err != nil {
-		eprintf("Error getting info of file: %s\n", srcfile.Name())
-		return // TODO: these returns should be os.Exit(1) ?
+	var fileInfo os.FileInfo
+	var err error
+	if srcfile != nil {
+		fileInfo, err = srcfile.Stat()
+		if err != nil {
+			eprintf("Error getting info of file: %s\n", srcfile.Name())
+			os.Exit(1)
+		}
 	}
 
-	// Create a TCP connection and perform handshake
-	conn, err := net.Dial("tcp", opts.flags.relayAddr)
-	if err != nil {
-		eprintf("Error connecting with server: %v\n", err)
-		return
+	clientOpts := client.Options{
+		ShareCode:        opts.flags.shareCode,
+		CodeWords:        opts.flags.words,
+		TTL:              opts.flags.ttl,
+		Logf:             eprintf,
+		HandshakeTimeout: opts.flags.handshakeTimeout,
+		WaitTimeout:      opts.flags.waitTimeout,
+		IdleTimeout:      opts.flags.idleTimeout,
+		NoDirect:         opts.flags.noDirect,
+		LAN:              opts.flags.lan,
+		TLS:              opts.relayTLS,
+		Token:            opts.token,
+		RateLimit:        int64(opts.flags.limit),
+		Compress:         ifelse(opts.flags.compress == "none", "", opts.flags.compress),
+		Receivers:        ifelse(opts.flags.maxReceivers == 0, -1, opts.flags.maxReceivers),
+		WaitAfterDecline: opts.flags.keepWaiting,
+		Async:            opts.flags.async,
+		OnDeclined: func() {
+			eprintf("Receiver declined the file\n")
+		},
+		OnReceiver: func(n int, result client.Result, err error) {
+			switch {
+			case err == nil:
+				eprintf("Receiver %d got the file, sent %d bytes\n", n, result.Transferred)
+			case errors.Is(err, proto.ErrCancelled):
+				eprintf("Receiver %d cancelled the transfer\n", n)
+			case errors.Is(err, client.ErrDeclined):
+				eprintf("Receiver %d declined the file\n", n)
+			default:
+				eprintf("Error sending file to receiver %d: %v\n", n, err)
+			}
+		},
 	}
-	defer conn.Close()
-	_, err = proto.WriteFrame(conn, proto.OpcodeHandshakeRequest, nil)
-	if err != nil {
-		eprintf("Error during handshake: %v\n", err)
-		return
-	}
-	dbgprintf("Handshake complete!\n")
-	opcode, _, err := proto.ReadFrame(conn)
-	if err != nil {
-		eprintf("Error reading handshake resposne: %v\n", err)
-		return
-	}
-	if opcode != proto.OpcodeHandshakeResponse {
-		eprintf("Couldn't complete handshake\n")
-		return
+
+	// Folders are streamed as an archive, receiver is told
+	// about number of files and their total size upfront
+	progress := newProgress(opts.flags.progress)
+	if progress != nil {
+		clientOpts.Progress = progress.update
 	}
+	ctx, stop := interruptContext()
+	defer stop()
 
-	// Perform send file request
-	_, err = proto.WriteFrame(
-		conn,
-		proto.OpcodeFileSendRequest,
-		proto.JSONToBytes(proto.FileSendRequestPayload{
-			ShareCode: opts.flags.shareCode,
-			Filesize:  fileInfo.Size(),
-			Filename:  fileInfo.Name(),
-		}),
-	)
-	if err != nil {
-		eprintf("Error during send file request: %v\n", err)
-		return
+	// Tell what's being sent along with the share code, uploads
+	// get theirs once the relay has stored all of it
+	announce := func(what string) {
+		if opts.flags.async {
+			eprintf("Uploading %s to relay...\n", what)
+			clientOpts.OnShareCode = printShareCode
+			return
+		}
+		clientOpts.OnShareCode = func(shareCode string, expiresIn time.Duration) {
+			printShareCode(shareCode, expiresIn)
+			eprintf("Sending %s, waiting for receiver...\n", what)
+		}
 	}
-	opcode, payload, err := proto.ReadFrame(conn)
-	if err != nil {
-		eprintf("Error reading send file response: %v\n", err)
-		return
-	}
-	if opcode != proto.OpcodeFileSendResponse {
-		if opcode == proto.OpcodeShareCodeNotAvailable {
-			eprintf("Share code is unavailable, use another or omit for a random code\n")
-		} else {
-			eprintf("Unexpected opcode from server, got (%d) want (%d), closing connection....\n", opcode, proto.OpcodeFileSendResponse)
+	var result client.Result
+	if srcfile == nil {
+		var size int64
+		for _, p := range opts.args.filepaths {
+			info, err := os.Stat(p)
+			if err != nil {
+				eprintf("Error opening file: %v\n", err)
+				os.Exit(1)
+			}
+			if !info.Mode().IsRegular() {
+				eprintf("Only regular files can be sent together, %q isn't one\n", p)
+				os.Exit(1)
+			}
+			size += info.Size()
+		}
+		announce(fmt.Sprintf("%d files (%s)", len(opts.args.filepaths), utils.ReadableSize(size)))
+		result, err = client.SendFiles(ctx, opts.flags.relayAddr, opts.args.filepaths, clientOpts)
+	} else if fileInfo.IsDir() {
+		var manifest archive.Manifest
+		manifest, err = archive.Scan(opts.args.filepaths[0])
+		if err != nil {
+			eprintf("Error reading folder: %v\n", err)
+			os.Exit(1)
+		}
+		announce(fmt.Sprintf("folder %q (%d files, %s)", srcfile.Name(), manifest.Files, utils.ReadableSize(manifest.Size)))
+		result, err = client.SendFolder(ctx, opts.flags.relayAddr, opts.args.filepaths[0], clientOpts)
+	} else {
+		// Size of pipes isn't known until they're read through,
+		// they're sent in chunks with the size told at the end
+		meta := client.Meta{
+			Name: cmp.Or(opts.flags.name, fileInfo.Name()),
+			Size: fileInfo.Size(),
 		}
-		return
+		if !fileInfo.Mode().IsRegular() {
+			meta.Size = -1
+		}
+		announce(fmt.Sprintf("%q (%s)", srcfile.Name(), readableSize(meta.Size)))
+		result, err = client.Send(ctx, opts.flags.relayAddr, srcfile, meta, clientOpts)
 	}
-	fileSendResp := proto.DecodeJSON[proto.FileSendResponsePayload](payload)
-	eprintf("Share code: %s\n", fileSendResp.ShareCode)
 
-	// Wait for server notification to start sending, then
-	// stream the file
-	eprintf("Sending %q (%s), waiting for receiver...\n", srcfile.Name(), readableSize(fileInfo.Size()))
-	opcode, payload, err = proto.ReadFrame(conn)
-	if opcode != proto.OpcodeCanStartSending {
-		eprintf("Unexpected opcode from server, got (%d) want (%d), closing connection....\n", opcode, proto.OpcodeCanStartSending)
-		return
-	}
-	sent, err := io.Copy(conn, srcfile)
-	if err != nil {
+	progress.finish()
+	var relayErr *proto.ErrorPayload
+	switch {
+	case err == nil && result.Stored:
+		eprintf("Uploaded %d bytes of data, relay deletes it after %d %s\n", result.Transferred, result.Downloads, ifelse(result.Downloads == 1, "download", "downloads"))
+	case err == nil && opts.flags.maxReceivers != 1:
+		eprintf("Sent %d bytes of data to %d receivers!\n", result.Transferred, result.Receivers)
+	case err == nil:
+		eprintf("Sent %d bytes of data!\n", result.Transferred)
+	case errors.As(err, &relayErr) && relayErr.Code == proto.ErrShareCodeNotAvailable:
+		eprintf("Share code is unavailable, use another or omit for a random code\n")
+		os.Exit(1)
+	case errors.As(err, &relayErr) && relayErr.Code == proto.ErrShareCodeExpired:
+		eprintf("Share code expired before anyone received the file\n")
+		os.Exit(1)
+	case errors.As(err, &relayErr) && relayErr.Code == proto.ErrShareCodeInvalidated:
+		eprintf("Relay invalidated the share code since too many receivers had a different one, send again with a new code\n")
+		os.Exit(1)
+	case errors.As(err, &relayErr) && relayErr.Code == proto.ErrStoreFull:
+		eprintf("Relay doesn't have room for the upload, try again later or send without -async\n")
+		os.Exit(1)
+	case errors.As(err, &relayErr) && relayErr.Code == proto.ErrUnauthorized:
+		printTokenHelp(relayErr)
+		os.Exit(1)
+	case errors.Is(err, context.Canceled) && opts.flags.maxReceivers != 1:
+		eprintf("Stopped sending, %d receivers got the file\n", result.Receivers)
+		os.Exit(130)
+	case errors.Is(err, context.Canceled):
+		eprintf("Transfer cancelled\n")
+		os.Exit(130)
+	case errors.Is(err, proto.ErrCancelled):
+		eprintf("Receiver cancelled the transfer\n")
+		os.Exit(1)
+	case errors.Is(err, client.ErrDeclined):
+		eprintf("Receiver declined the file\n")
+		os.Exit(1)
+	default:
 		eprintf("Error sending file: %v\n", err)
-		return
-	}
-	if sent != fileInfo.Size() {
-		eprintf("Couldn't send whole file, sent (%d/%d) bytes\n", sent, fileInfo.Size())
-		return
+		os.Exit(1)
 	}
-	eprintf("Sent %d bytes of data!\n", sent)
-
-	// NOW STREAM ITTTT!!!!
-	return
-
-	// for {
-	// 	n, err := conn.Read(buf[:]) // TODO: what if 2048 is not enough
-	// 	if err != nil {
-	// 		eprintf("Error reading from connection: %v\n", err)
-	// 		return
-	// 	}
-	// 	utils.Assert(n > 0, "read n <= 0 bytes")
-
-	// 	opcode, data := buf[0], buf[1:n]
-	// 	switch opcode {
-	// 	case proto.OpcodeHandshakeResponse:
-	// 		eprintf("Handshake complete!\n")
-
-	// 	case proto.OpcodeFileSendResponse:
-	// 		var details proto.FileSendResponsePayload
-	// 		err := json.Unmarshal(data, &details)
-	// 		if err != nil {
-	// 			eprintf("Couldn't decode server's message, closing...\n")
-	// 			return
-	// 		}
-	// 		eprintf("File share code: %s\n", details.ShareCode)
-	// 		eprintf("On other machine run:\n  ./bullet recv %s\n", details.ShareCode)
+}
 
-	// 	// Invalid cases, clients don't receive requests from server
-	// 	case proto.OpcodeFileRecvResponse: // we are sending not recieving
-	// 	case proto.OpcodeHandshakeRequest,
-	// 		proto.OpcodeFileRecvRequest,
-	// 		proto.OpcodeFileSendRequest:
-	// 		eprintf("Undesired opcode (%d) returned, closing connection....\n", opcode)
-	// 		return
-	// 	default:
-	// 		eprintf("Unrecognized opcode (%d) returned, closing connection....\n", opcode)
-	// 		return
-	// 	}
-	// }
+func printShareCode(shareCode string, expiresIn time.Duration) {
+	if expiresIn > 0 {
+		eprintf("Share code: %s (code expires in %s)\n", shareCode, shortDuration(expiresIn))
+	} else {
+		eprintf("Share code: %s\n", shareCode)
+	}
 }
 
 func mustParseSendCmd(args []string) sendCmdOpts {
@@ -151,9 +223,24 @@ func mustParseSendCmd(args []string) sendCmdOpts {
 
 	cmd := flag.NewFlagSet("send", flag.ExitOnError)
 	cmd.StringVar(&opts.flags.relayAddr, "relay", "", "Relay server address")
-	cmd.StringVar(&opts.flags.shareCode, "code", "", "Custom share code for file, randomly generated if not provided")
+	cmd.StringVar(&opts.flags.shareCode, "code", "", "Custom share code for file of the form CHANNEL-SECRET, randomly generated if not provided")
+	cmd.IntVar(&opts.flags.words, "words", 3, "Number of words in the generated share code, 0 for random characters instead")
+	cmd.DurationVar(&opts.flags.ttl, "ttl", 0, "How long the share code stays valid, capped by relay's maximum (default relay's default)")
+	cmd.DurationVar(&opts.flags.handshakeTimeout, "handshake-timeout", defaultHandshakeTimeout, "Time limit for connecting and registering with relay")
+	cmd.DurationVar(&opts.flags.waitTimeout, "wait-timeout", 0, "Time limit for waiting on receiver to connect and accept the file, 0 for no limit")
+	cmd.DurationVar(&opts.flags.idleTimeout, "idle-timeout", defaultIdleTimeout, "Give up if no data moves for this long during transfer")
+	cmd.BoolVar(&opts.flags.noDirect, "no-direct", false, "Always transfer through the relay, without trying to connect directly")
+	cmd.BoolVar(&opts.flags.lan, "lan", false, "Find the receiver on the local network instead of going through a relay")
+	cmd.StringVar(&opts.flags.progress, "progress", progressAuto, "How to show progress: auto (a bar if stderr is a terminal), bar, json or none")
+	cmd.StringVar(&opts.flags.name, "name", "", "File name to tell the receiver, defaults to name of the file (stdin when sending -)")
+	cmd.StringVar(&opts.flags.compress, "compress", "none", "Compress data on the way if the receiver supports it, gzip or none")
+	cmd.BoolVar(&opts.flags.keepWaiting, "keep-waiting", false, "When the receiver declines the file, wait for another one with the same share code instead of exiting")
+	cmd.BoolVar(&opts.flags.async, "async", false, "Upload the file to the relay and exit, receivers get it from there until it expires or has been downloaded")
+	cmd.IntVar(&opts.flags.maxReceivers, "max-receivers", 1, "How many receivers can get the file with the same share code, 0 for no limit until Ctrl-C or the code expires")
+	cmd.Var(&opts.flags.limit, "limit", "Limit how fast data is sent to this `rate`, like 20MB/s (default no limit)")
+	opts.flags.relayTLS.register(cmd)
 	cmd.Usage = func() {
-		eprintf("Usage: %s send [FLAGS] FILE\n\n", os.Args[0])
+		eprintf("Usage: %s send [FLAGS] FILE...|FOLDER|-\n\n", os.Args[0])
 		eprintf("FLAGS:\n")
 		cmd.PrintDefaults()
 	}
@@ -164,15 +251,59 @@ func mustParseSendCmd(args []string) sendCmdOpts {
 	if opts.flags.relayAddr == "" {
 		opts.flags.relayAddr = defaultRelayAddr
 	}
-	if opts.flags.shareCode == "" {
-		opts.flags.shareCode = utils.RandCode()
+	relayTLS, err := opts.flags.relayTLS.config()
+	if err != nil {
+		eprintf("%v\n", err)
+		os.Exit(1)
+	}
+	opts.relayTLS = relayTLS
+	opts.token, err = relayToken()
+	if err != nil {
+		eprintf("%v\n", err)
+		os.Exit(1)
+	}
+	if !slices.Contains(progressModes, opts.flags.progress) {
+		eprintf("-progress must be one of %s\n", strings.Join(progressModes, ", "))
+		os.Exit(1)
+	}
+	if opts.flags.compress != "none" && opts.flags.compress != proto.CapGzip {
+		eprintf("-compress must be gzip or none\n")
+		os.Exit(1)
+	}
+	if opts.flags.words < 0 || opts.flags.words > maxCodeWords {
+		eprintf("-words must be between 0 and %d\n", maxCodeWords)
+		os.Exit(1)
+	}
+	if opts.flags.maxReceivers < 0 {
+		eprintf("-max-receivers can't be negative\n")
+		os.Exit(1)
+	}
+	if opts.flags.async && (opts.flags.shareCode != "" || opts.flags.lan || opts.flags.maxReceivers != 1 || opts.flags.keepWaiting) {
+		eprintf("-async can't be used with -code, -lan, -max-receivers or -keep-waiting\n")
+		os.Exit(1)
+	}
+	if opts.flags.shareCode != "" {
+		if _, _, err := proto.SplitShareCode(opts.flags.shareCode); err != nil {
+			eprintf("%v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	if cmd.NArg() != 1 {
+	if cmd.NArg() < 1 {
 		cmd.Usage()
 		os.Exit(1)
 	}
-	opts.args.filepath = cmd.Arg(0)
+	opts.args.filepaths = cmd.Args()
+	if cmd.NArg() > 1 {
+		if slices.Contains(opts.args.filepaths, "-") {
+			eprintf("Can't send stdin along with other files\n")
+			os.Exit(1)
+		}
+		if opts.flags.name != "" {
+			eprintf("-name only applies when sending a single file\n")
+			os.Exit(1)
+		}
+	}
 
 	return opts
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Flags for connecting with the relay over TLS, shared by send and recv
+type relayTLSFlags struct {
+	enabled     bool
+	caFile      string
+	fingerprint string
+}
+
+func (f *relayTLSFlags) register(cmd *flag.FlagSet) {
+	cmd.BoolVar(&f.enabled, "tls", false, "Connect with the relay over TLS")
+	cmd.StringVar(&f.caFile, "relay-ca", "", "Trust relay certificates signed by CAs in this PEM file instead of the system's, implies -tls")
+	cmd.StringVar(&f.fingerprint, "relay-fingerprint", "", "Only trust the relay certificate with this SHA-256 fingerprint in hex, like a self-signed one, implies -tls")
+}
+
+// Returns the TLS config to connect with the relay, nil if TLS isn't wanted
+func (f *relayTLSFlags) config() (*tls.Config, error) {
+	if !f.enabled && f.caFile == "" && f.fingerprint == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if f.caFile != "" {
+		pem, err := os.ReadFile(f.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading relay CA: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", f.caFile)
+		}
+	}
+	if f.fingerprint != "" {
+		want, err := hex.DecodeString(strings.ReplaceAll(f.fingerprint, ":", ""))
+		if err != nil || len(want) != sha256.Size {
+			return nil, errors.New("relay fingerprint must be a SHA-256 hash in hex")
+		}
+		// The pinned certificate is trusted on its own, whoever signed it
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("relay sent no certificate")
+			}
+			have := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare(have[:], want) != 1 {
+				return fmt.Errorf("relay certificate fingerprint is %x, not the pinned one", have)
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
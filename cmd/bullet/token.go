@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// API token for relays that restrict access is read from this env var,
+// or from the "bullet/token" file in the user's config directory
+const tokenEnv = "BULLET_TOKEN"
+
+// Returns the API token to present to the relay, empty if there's none
+func relayToken() (string, error) {
+	if token := os.Getenv(tokenEnv); token != "" {
+		return token, nil
+	}
+	path := tokenFile()
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading API token: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Path of the file the API token is read from,
+// empty if there's no config directory
+func tokenFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "bullet", "token")
+}
+
+// Tells how to give the relay an API token, after it refused us for not having one
+func printTokenHelp(relayErr error) {
+	eprintf("Relay refused the connection: %v\n", relayErr)
+	eprintf("Get an API token from whoever runs the relay, and set %s or put it in %q\n", tokenEnv, tokenFile())
+}
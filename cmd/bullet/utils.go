@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/diwasrimal/bullet/pkg/utils"
 )
 
 // Prints to [os.Stderr]
@@ -10,19 +16,6 @@ func eprintf(format string, a ...any) {
 	fmt.Fprintf(os.Stderr, format, a...)
 }
 
-func readableSize(b int64) string {
-	const unit = 1000
-	if b < unit {
-		return fmt.Sprintf("%d B", b)
-	}
-	div, exp := int64(unit), 0
-	for n := b / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
-	}
-	return fmt.Sprintf("%.1f%cB", float64(b)/float64(div), "kMGTPE"[exp])
-}
-
 func dbgprintf(format string, a ...any) {
 	if debugEnabled {
 		fmt.Fprintf(os.Stderr, format, a...)
@@ -35,3 +28,51 @@ func ifelse[T any](cond bool, a, b T) T {
 	}
 	return b
 }
+
+// Returns a context cancelled on Ctrl-C, so that transfers can be aborted
+// cleanly. A second Ctrl-C kills the program as usual.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	context.AfterFunc(ctx, stop)
+	return ctx, stop
+}
+
+// Prints a question to stderr and returns the answer read from stdin,
+// empty if nothing was typed. Gives up with ctx's error once ctx is done,
+// so that Ctrl-C doesn't wait for an answer.
+func ask(ctx context.Context, format string, a ...any) (string, error) {
+	eprintf(format, a...)
+	answer := make(chan string, 1)
+	go func() {
+		var resp string
+		fmt.Scanln(&resp)
+		answer <- resp
+	}()
+	select {
+	case resp := <-answer:
+		return resp, nil
+	case <-ctx.Done():
+		eprintf("\n")
+		return "", ctx.Err()
+	}
+}
+
+// Formats d without trailing zero units, like 10m instead of 10m0s
+func shortDuration(d time.Duration) string {
+	s := d.Round(time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// Like utils.ReadableSize, but for sizes that might not be known
+func readableSize(size int64) string {
+	if size < 0 {
+		return "size unknown"
+	}
+	return utils.ReadableSize(size)
+}
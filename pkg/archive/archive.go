@@ -0,0 +1,268 @@
+// Package archive streams a folder as a sequence of proto frames, similar
+// to tar. Each file or directory is described by a [proto.OpcodeArchiveEntry]
+// frame holding its relative path, mode and mtime, followed by the file's
+// data. The stream ends with a [proto.OpcodeArchiveEnd] frame.
+//
+// Only regular files and directories are sent, other entries like symlinks
+// are skipped. Several loose files can be streamed the same way, as entries
+// named by their base names.
+package archive
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+
+	"github.com/diwasrimal/bullet/pkg/proto"
+)
+
+// Manifest summarizes a folder before it's streamed
+type Manifest struct {
+	Files int   // number of regular files
+	Dirs  int   // number of directories, excluding the root
+	Size  int64 // total size of all files
+}
+
+// Scan walks the folder at root and returns its manifest.
+func Scan(root string) (Manifest, error) {
+	var m Manifest
+	err := walk(root, func(_ string, d fs.DirEntry, info fs.FileInfo) error {
+		if d.IsDir() {
+			m.Dirs++
+		} else {
+			m.Files++
+			m.Size += info.Size()
+		}
+		return nil
+	})
+	return m, err
+}
+
+// Write streams the folder at root to w, returns the number of
+// file data bytes written.
+func Write(w io.Writer, root string) (written int64, err error) {
+	err = walk(root, func(relpath string, d fs.DirEntry, info fs.FileInfo) error {
+		entry := proto.ArchiveEntryPayload{
+			Path:    relpath,
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		}
+		if d.IsDir() {
+			_, err := proto.WriteFrame(w, proto.OpcodeArchiveEntry, proto.JSONToBytes(entry))
+			return err
+		}
+		entry.Size = info.Size()
+		n, err := writeFile(w, filepath.Join(root, filepath.FromSlash(relpath)), entry)
+		written += n
+		return err
+	})
+	if err != nil {
+		return written, err
+	}
+	_, err = proto.WriteFrame(w, proto.OpcodeArchiveEnd, nil)
+	return written, err
+}
+
+// WriteFiles streams the regular files at paths to w as entries named by
+// their base names, returns the number of file data bytes written.
+func WriteFiles(w io.Writer, paths []string) (written int64, err error) {
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return written, err
+		}
+		if !info.Mode().IsRegular() {
+			return written, fmt.Errorf("%s is not a regular file", p)
+		}
+		n, err := writeFile(w, p, proto.ArchiveEntryPayload{
+			Path:    filepath.Base(p),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+		})
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	_, err = proto.WriteFrame(w, proto.OpcodeArchiveEnd, nil)
+	return written, err
+}
+
+// Writes entry followed by data of the file at p
+func writeFile(w io.Writer, p string, entry proto.ArchiveEntryPayload) (int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := proto.WriteFrame(w, proto.OpcodeArchiveEntry, proto.JSONToBytes(entry)); err != nil {
+		return 0, err
+	}
+	// Receiver expects exactly the size we announced, so a file that
+	// changed while being sent is an error
+	n, err := io.CopyN(w, f, entry.Size)
+	if err == io.EOF {
+		return n, fmt.Errorf("%s shrank while being sent", entry.Path)
+	}
+	return n, err
+}
+
+// Extract reads a folder stream from r and recreates it inside dest.
+// Entries with paths that would escape dest are rejected.
+// Returns the number of files and file data bytes extracted.
+func Extract(r io.Reader, dest string) (files int, size int64, err error) {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return 0, 0, err
+	}
+
+	// Directory modes and mtimes are applied at the end, since creating
+	// files inside them would change mtime, and mode might not allow writes
+	var dirs []proto.ArchiveEntryPayload
+
+	for {
+		opcode, payload, err := proto.ReadFrame(r)
+		if err != nil {
+			return files, size, err
+		}
+		if opcode == proto.OpcodeArchiveEnd {
+			break
+		}
+		if opcode != proto.OpcodeArchiveEntry {
+			return files, size, fmt.Errorf("unexpected opcode in archive (%d)", opcode)
+		}
+		entry, err := proto.ParseJSON[proto.ArchiveEntryPayload](payload)
+		if err != nil {
+			return files, size, fmt.Errorf("malformed archive entry: %w", err)
+		}
+		target, err := sanitize(dest, entry.Path)
+		if err != nil {
+			return files, size, err
+		}
+
+		if entry.Mode.IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return files, size, err
+			}
+			dirs = append(dirs, entry)
+			continue
+		}
+		if !entry.Mode.IsRegular() {
+			return files, size, fmt.Errorf("unsupported entry %q in archive", entry.Path)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return files, size, err
+		}
+		n, err := extractFile(r, target, entry)
+		size += n
+		if err != nil {
+			return files, size, err
+		}
+		files++
+	}
+
+	// Deepest directories first so that parent mtimes stay intact
+	slices.Reverse(dirs)
+	for _, entry := range dirs {
+		target, _ := sanitize(dest, entry.Path)
+		os.Chmod(target, entry.Mode.Perm())
+		os.Chtimes(target, entry.ModTime, entry.ModTime)
+	}
+	return files, size, nil
+}
+
+// ExtractFiles reads files streamed by [WriteFiles] from r into dest,
+// which must be exactly the ones in want, in that order. Only files with
+// keep set are written, others are read and discarded. All of them are
+// written if keep is nil. Returns the number of file data bytes extracted.
+func ExtractFiles(r io.Reader, dest string, want []proto.ManifestEntry, keep []bool) (size int64, err error) {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return 0, err
+	}
+	for i, file := range want {
+		payload, err := proto.ReadExpectedFrame(r, proto.OpcodeArchiveEntry)
+		if err != nil {
+			return size, err
+		}
+		entry, err := proto.ParseJSON[proto.ArchiveEntryPayload](payload)
+		if err != nil {
+			return size, fmt.Errorf("malformed archive entry: %w", err)
+		}
+		if entry.Path != file.Name || entry.Size != file.Size || !entry.Mode.IsRegular() {
+			return size, fmt.Errorf("unexpected entry %q in stream, want %q", entry.Path, file.Name)
+		}
+		target, err := sanitize(dest, entry.Path)
+		if err != nil || filepath.Dir(target) != filepath.Clean(dest) {
+			return size, fmt.Errorf("refusing to extract unsafe path %q", entry.Path)
+		}
+		if keep != nil && !keep[i] {
+			if _, err := io.CopyN(io.Discard, r, entry.Size); err != nil {
+				return size, err
+			}
+			continue
+		}
+		n, err := extractFile(r, target, entry)
+		size += n
+		if err != nil {
+			return size, err
+		}
+	}
+	_, err = proto.ReadExpectedFrame(r, proto.OpcodeArchiveEnd)
+	return size, err
+}
+
+func extractFile(r io.Reader, target string, entry proto.ArchiveEntryPayload) (int64, error) {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.Mode.Perm())
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.CopyN(f, r, entry.Size)
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+	os.Chmod(target, entry.Mode.Perm()) // OpenFile doesn't change mode of existing files
+	os.Chtimes(target, entry.ModTime, entry.ModTime)
+	return n, nil
+}
+
+// Returns the path in dest where an entry should be written,
+// making sure it can't escape dest with ../ or absolute paths.
+func sanitize(dest, relpath string) (string, error) {
+	cleaned := path.Clean(relpath)
+	local := filepath.FromSlash(cleaned)
+	if relpath == "" || cleaned == "." || !filepath.IsLocal(local) {
+		return "", fmt.Errorf("refusing to extract unsafe path %q", relpath)
+	}
+	return filepath.Join(dest, local), nil
+}
+
+// Walks the folder at root in lexical order calling fn for each directory
+// and regular file below it, with paths relative to root and slash separated.
+func walk(root string, fn func(relpath string, d fs.DirEntry, info fs.FileInfo) error) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root || !(d.IsDir() || d.Type().IsRegular()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		relpath, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(relpath), d, info)
+	})
+}
@@ -0,0 +1,235 @@
+package archive
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwasrimal/bullet/pkg/proto"
+)
+
+// Creates files under root, named by slash separated paths. Paths
+// ending with a slash are directories.
+func mkfiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExtractRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	mkfiles(t, src, map[string]string{
+		"a.txt":           "hello",
+		"empty":           "",
+		"sub/b.txt":       strings.Repeat("b", 100000),
+		"sub/deeper/c.md": "# c",
+		"nothing/":        "",
+	})
+	if err := os.Chmod(filepath.Join(src, "a.txt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "sub"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Scan(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Manifest{Files: 4, Dirs: 3, Size: 100008}); m != want {
+		t.Errorf("Scan() = %+v, want %+v", m, want)
+	}
+	var buf bytes.Buffer
+	written, err := Write(&buf, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != m.Size {
+		t.Errorf("Write() wrote %d bytes, want %d", written, m.Size)
+	}
+
+	dest := filepath.Join(t.TempDir(), "out")
+	files, size, err := Extract(&buf, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != m.Files || size != m.Size {
+		t.Errorf("Extract() = %d files, %d bytes, want %d files, %d bytes", files, size, m.Files, m.Size)
+	}
+	for _, name := range []string{"a.txt", "empty", "sub/b.txt", "sub/deeper/c.md"} {
+		want, _ := os.ReadFile(filepath.Join(src, name))
+		got, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Errorf("reading extracted %s: %v", name, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("extracted %s differs from the original", name)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dest, "nothing")); err != nil || !info.IsDir() {
+		t.Errorf("empty directory wasn't extracted: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "a.txt")); err == nil && info.Mode().Perm() != 0600 {
+		t.Errorf("extracted a.txt has mode %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+	if info, err := os.Stat(filepath.Join(dest, "sub")); err == nil && !info.ModTime().Equal(mtime) {
+		t.Errorf("extracted sub has mtime %v, want %v", info.ModTime(), mtime)
+	}
+}
+
+func TestExtractRejects(t *testing.T) {
+	file := proto.ArchiveEntryPayload{Path: "x", Mode: 0644, Size: 1}
+	for name, frames := range map[string]func(w *bytes.Buffer){
+		"escaping path": func(w *bytes.Buffer) {
+			entry := file
+			entry.Path = "../x"
+			proto.WriteFrame(w, proto.OpcodeArchiveEntry, proto.JSONToBytes(entry))
+			w.WriteString("x")
+		},
+		"malformed entry": func(w *bytes.Buffer) {
+			proto.WriteFrame(w, proto.OpcodeArchiveEntry, []byte("{not json"))
+		},
+		"symlink": func(w *bytes.Buffer) {
+			entry := file
+			entry.Mode = os.ModeSymlink | 0777
+			proto.WriteFrame(w, proto.OpcodeArchiveEntry, proto.JSONToBytes(entry))
+		},
+		"short file": func(w *bytes.Buffer) {
+			entry := file
+			entry.Size = 10
+			proto.WriteFrame(w, proto.OpcodeArchiveEntry, proto.JSONToBytes(entry))
+			w.WriteString("x")
+		},
+		"unexpected frame": func(w *bytes.Buffer) {
+			proto.WriteFrame(w, proto.OpcodeKeyConfirm, nil)
+		},
+		"no end": func(w *bytes.Buffer) {
+			proto.WriteFrame(w, proto.OpcodeArchiveEntry, proto.JSONToBytes(file))
+			w.WriteString("x")
+		},
+	} {
+		var buf bytes.Buffer
+		frames(&buf)
+		root := t.TempDir()
+		dest := filepath.Join(root, "out")
+		if _, _, err := Extract(&buf, dest); err == nil {
+			t.Errorf("%s: Extract() succeeded", name)
+		}
+		if _, err := os.Stat(filepath.Join(root, "x")); err == nil {
+			t.Errorf("%s: file was written outside of dest", name)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	dest := filepath.Join("tmp", "dest")
+	for relpath, want := range map[string]string{
+		"x":          filepath.Join(dest, "x"),
+		"a/b/c.txt":  filepath.Join(dest, "a", "b", "c.txt"),
+		"a/../x":     filepath.Join(dest, "x"),
+		"./a//b":     filepath.Join(dest, "a", "b"),
+		"..x/y":      filepath.Join(dest, "..x", "y"),
+		"../x":       "",
+		"a/../../x":  "",
+		"..":         "",
+		"/abs":       "",
+		"/abs/x/../": "",
+		"":           "",
+		".":          "",
+		"a/..":       "",
+	} {
+		got, err := sanitize(dest, relpath)
+		switch {
+		case want == "" && err == nil:
+			t.Errorf("sanitize(%q) = %q, want an error", relpath, got)
+		case want != "" && err != nil:
+			t.Errorf("sanitize(%q) failed: %v", relpath, err)
+		case got != want:
+			t.Errorf("sanitize(%q) = %q, want %q", relpath, got, want)
+		}
+	}
+}
+
+func TestExtractFiles(t *testing.T) {
+	src := t.TempDir()
+	mkfiles(t, src, map[string]string{"a.txt": "hello", "b.bin": "world!"})
+	want := []proto.ManifestEntry{{Name: "a.txt", Size: 5}, {Name: "b.bin", Size: 6}}
+	var buf bytes.Buffer
+	if _, err := WriteFiles(&buf, []string{filepath.Join(src, "a.txt"), filepath.Join(src, "b.bin")}); err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	size, err := ExtractFiles(bytes.NewReader(buf.Bytes()), dest, want, []bool{false, true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 6 {
+		t.Errorf("ExtractFiles() extracted %d bytes, want 6", size)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "a.txt")); err == nil {
+		t.Error("file that wasn't picked got extracted")
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "b.bin")); string(got) != "world!" {
+		t.Errorf("extracted b.bin holds %q, want %q", got, "world!")
+	}
+}
+
+func TestExtractFilesRejects(t *testing.T) {
+	entry := func(path string, size int64) []byte {
+		return proto.JSONToBytes(proto.ArchiveEntryPayload{Path: path, Mode: 0644, Size: size})
+	}
+	for name, c := range map[string]struct {
+		want    []proto.ManifestEntry
+		payload []byte
+	}{
+		"malformed entry": {
+			want:    []proto.ManifestEntry{{Name: "x", Size: 1}},
+			payload: []byte(`{"path": 7`),
+		},
+		"other name": {
+			want:    []proto.ManifestEntry{{Name: "x", Size: 1}},
+			payload: entry("y", 1),
+		},
+		"other size": {
+			want:    []proto.ManifestEntry{{Name: "x", Size: 1}},
+			payload: entry("x", 2),
+		},
+		"escaping name": {
+			want:    []proto.ManifestEntry{{Name: "../x", Size: 1}},
+			payload: entry("../x", 1),
+		},
+		"name in a subdirectory": {
+			want:    []proto.ManifestEntry{{Name: "sub/x", Size: 1}},
+			payload: entry("sub/x", 1),
+		},
+	} {
+		var buf bytes.Buffer
+		proto.WriteFrame(&buf, proto.OpcodeArchiveEntry, c.payload)
+		buf.WriteString("x")
+		proto.WriteFrame(&buf, proto.OpcodeArchiveEnd, nil)
+		root := t.TempDir()
+		dest := filepath.Join(root, "out")
+		if _, err := ExtractFiles(&buf, dest, c.want, nil); err == nil {
+			t.Errorf("%s: ExtractFiles() succeeded", name)
+		}
+		if _, err := os.Stat(filepath.Join(root, "x")); err == nil {
+			t.Errorf("%s: file was written outside of dest", name)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+// Package client sends and receives files through a bullet relay, so that
+// transfers can be embedded in other programs. The bullet CLI is a thin
+// wrapper around it.
+//
+// A transfer starts with the sender registering with the relay and getting
+// back a share code, which the receiver then uses to get paired with the
+// sender. Everything after pairing is end-to-end encrypted with a key derived
+// from the share code, see [secure.Establish].
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/diwasrimal/bullet/pkg/proto"
+	"github.com/diwasrimal/bullet/pkg/ratelimit"
+)
+
+var (
+	ErrRelayTooOld    = errors.New("relay too old")
+	ErrClientTooOld   = errors.New("client too old")
+	ErrUnsupported    = errors.New("peer doesn't support this, ask them to upgrade bullet")
+	ErrDeclined       = errors.New("receiver declined the transfer")
+	ErrIncomplete     = errors.New("transfer ended before all data was sent")
+	ErrDigestMismatch = errors.New("hash mismatch, received data is corrupted")
+	ErrTimeout        = errors.New("timed out")
+)
+
+// Meta describes what's being transferred
+type Meta struct {
+	Name  string
+	Size  int64 // size of the file, or total size of files in a folder, -1 if not known upfront
+	IsDir bool
+	Files int // number of files in the folder, or of several files sent together
+
+	// Name and size of each file, when several files are sent together
+	// instead of a single one
+	Manifest []proto.ManifestEntry
+}
+
+// Options for both sending and receiving, fields that apply to only one
+// side are ignored by the other. The zero value is ready to use.
+type Options struct {
+	// Share code to send with, of the form CHANNEL-SECRET. A random one
+	// is used if empty. Sender only.
+	ShareCode string
+
+	// Random share codes are made of this many words, like
+	// 7-crystal-pigeon-harbor, each adding 10 bits of entropy.
+	// Random characters are used if zero. Sender only.
+	CodeWords int
+
+	// How long the share code should stay valid, relay's default is used if
+	// zero. The relay may cap it. Sender only.
+	TTL time.Duration
+
+	// Called with the share code once the relay has registered the sender,
+	// it should be given to the receiver before it expires. expiresIn is
+	// zero if it doesn't. Sender only.
+	OnShareCode func(shareCode string, expiresIn time.Duration)
+
+	// How many receivers can get the file with the same share code, zero
+	// meaning one and negative meaning no limit, until ctx is done or the
+	// share code expires. Each receiver is served on its own connection
+	// with the relay, so the reader given to Send must be an [io.ReaderAt].
+	// OnReceiver is called as each one finishes, n counting them from 1 in
+	// the order they showed up, possibly concurrently. Sender only.
+	Receivers  int
+	OnReceiver func(n int, result Result, err error)
+
+	// When sending to a single receiver who declines the file, register
+	// the same share code again and wait for another one instead of
+	// returning ErrDeclined. OnDeclined is called each time. Sender only.
+	WaitAfterDecline bool
+	OnDeclined       func()
+
+	// Uploads the file to the relay's storage instead of waiting for a
+	// receiver, returning once the relay has all of it. Receivers get it
+	// from there until it expires or has been downloaded as many times as
+	// the relay allows, OnShareCode tells when it expires. The relay could
+	// try guessing the secret offline, so the share code is always picked
+	// at random. Can't be used with ShareCode, LAN or Receivers. Sender only.
+	Async bool
+
+	// Limits data sent or received to this many bytes per second, zero
+	// meaning no limit. Receivers of a fan-out sender share the limit.
+	RateLimit int64
+	limiter   *ratelimit.Limiter // made from RateLimit once per Send or Receive
+
+	// Compresses data sent with this codec, only proto.CapGzip for now.
+	// Data goes uncompressed if the receiver doesn't support it, or if
+	// empty. Sender only.
+	Compress string
+
+	// Called to decide where to extract a folder that's being received,
+	// returning an error declines it. Folders are declined if nil.
+	// Receiver only.
+	AcceptFolder func(meta Meta) (dirpath string, err error)
+
+	// Called when the sender offers several files, with their names and
+	// sizes in meta.Manifest. Returns the directory to write them in and
+	// indices of the ones to receive, in order. Returning an error declines
+	// them all. Several files are declined if nil. Receiver only.
+	AcceptFiles func(meta Meta) (dirpath string, selected []int, err error)
+
+	// Called as data is transferred with the number of bytes done so far,
+	// including any part skipped due to resuming, out of meta's size
+	// which is -1 if not known
+	Progress func(done, total int64)
+
+	// Called with informational messages, like whether a transfer was resumed
+	Logf func(format string, a ...any)
+
+	// Timeouts for each phase of the transfer, zero means no limit.
+	// HandshakeTimeout limits connecting and registering with the relay.
+	// WaitTimeout limits waiting on the peer, like for a receiver to show up
+	// or for them to accept the file. IdleTimeout limits each read or write
+	// after that, so that a stalled transfer fails instead of hanging.
+	HandshakeTimeout time.Duration
+	WaitTimeout      time.Duration
+	IdleTimeout      time.Duration
+
+	// Peers try connecting with each other directly once paired, and only
+	// use the relay if that doesn't work within DirectTimeout (2s if zero).
+	// NoDirect always uses the relay.
+	NoDirect      bool
+	DirectTimeout time.Duration
+
+	// LAN finds the peer on the local network instead of through a relay,
+	// sender announcing the channel over multicast and receiver connecting
+	// to it directly. relayAddr is ignored, and both peers must use it.
+	LAN bool
+
+	// Connects with the relay over TLS with this config if not nil.
+	// ServerName is taken from relayAddr if empty.
+	TLS *tls.Config
+
+	// API token presented to the relay, for relays that restrict access
+	Token string
+}
+
+// Returns a context for a phase limited by timeout, if there's one.
+// Running out of time is reported as ErrTimeout.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, ErrTimeout)
+}
+
+func (o *Options) logf(format string, a ...any) {
+	if o.Logf != nil {
+		o.Logf(format, a...)
+	}
+}
+
+// Summary of a finished transfer
+type Result struct {
+	ShareCode   string
+	Meta        Meta
+	Offset      int64  // bytes skipped since receiver already had them
+	Transferred int64  // bytes of file data actually sent over the network
+	SHA256      string // hex encoded hash of the whole file, empty if peer doesn't support it
+	Direct      bool   // data went through a direct connection with the peer instead of the relay
+	Receivers   int    // ones that got the whole file, when sending to several
+	Stored      bool   // file went through the relay's storage instead of straight between peers
+	Downloads   int    // times a stored upload can be downloaded before the relay deletes it
+}
+
+// Connection with the relay. Every read and write gets a deadline when
+// timeout is set, and frames are written whole so that a cancel frame
+// never ends up in the middle of another frame.
+type relayConn struct {
+	net.Conn
+	timeout time.Duration // for each read and write in current phase
+
+	observedAddr string // our address as seen by the relay, if it told us
+
+	mu     sync.Mutex // held while writing
+	paired bool       // frames reach the peer once paired
+	broken bool       // a frame was partially written, no more can follow
+}
+
+func (c *relayConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *relayConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	n, err := c.Conn.Write(p)
+	if err != nil && n > 0 {
+		c.broken = true
+	}
+	return n, err
+}
+
+// Marks that we've been paired with the peer
+func (c *relayConn) setPaired() {
+	c.mu.Lock()
+	c.paired = true
+	c.mu.Unlock()
+}
+
+// Closes the connection, telling the peer we gave up if we've been paired
+func (c *relayConn) cancel() {
+	// Don't wait long on a write in progress, or for the cancel frame itself
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paired && !c.broken {
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		proto.WriteFrame(c.Conn, proto.OpcodeCancel, nil)
+	}
+	c.Conn.Close()
+}
+
+// Connects with the relay and completes the handshake, returning
+// capabilities supported by both us and the relay.
+func connect(ctx context.Context, relayAddr string, opts Options) (conn *relayConn, relayCaps []string, err error) {
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", relayAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting with relay: %w", err)
+	}
+	if tlsConfig := opts.TLS; tlsConfig != nil {
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(relayAddr)
+		}
+		tlsConn := tls.Client(netConn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			netConn.Close()
+			return nil, nil, fmt.Errorf("securing connection with relay: %w", err)
+		}
+		netConn = tlsConn
+	}
+	resp, err := handshake(ctx, netConn, opts.Token)
+	if err != nil {
+		netConn.Close()
+		return nil, nil, err
+	}
+	return &relayConn{Conn: netConn, observedAddr: resp.ObservedAddr}, resp.Capabilities, nil
+}
+
+// Agrees on protocol version and capabilities with the relay
+func handshake(ctx context.Context, conn net.Conn, token string) (proto.HandshakeResponsePayload, error) {
+	_, err := proto.WriteFrameContext(ctx, conn, proto.OpcodeHandshakeRequest, proto.JSONToBytes(proto.HandshakeRequestPayload{
+		Version:      proto.ProtocolVersion,
+		Capabilities: proto.Capabilities,
+		Token:        token,
+	}))
+	if err != nil {
+		return proto.HandshakeResponsePayload{}, fmt.Errorf("during handshake: %w", err)
+	}
+	opcode, payload, err := proto.ReadFrameContext(ctx, conn)
+	if err != nil {
+		return proto.HandshakeResponsePayload{}, fmt.Errorf("reading handshake response: %w", err)
+	}
+	switch opcode {
+	case proto.OpcodeHandshakeResponse:
+	case proto.OpcodeVersionMismatch:
+		resp, _ := proto.ParseJSON[proto.HandshakeResponsePayload](payload)
+		return proto.HandshakeResponsePayload{}, fmt.Errorf("%w, relay needs protocol version %d or newer but we speak %d, please upgrade bullet", ErrClientTooOld, resp.MinVersion, proto.ProtocolVersion)
+	case proto.OpcodeError:
+		resp, err := proto.ParseJSON[proto.ErrorPayload](payload)
+		if err != nil {
+			return proto.HandshakeResponsePayload{}, errors.New("couldn't complete handshake")
+		}
+		return proto.HandshakeResponsePayload{}, &resp
+	default:
+		return proto.HandshakeResponsePayload{}, errors.New("couldn't complete handshake")
+	}
+
+	resp := proto.HandshakeResponsePayload{Version: 1} // old relays reply with nothing
+	if len(payload) > 0 {
+		resp, err = proto.ParseJSON[proto.HandshakeResponsePayload](payload)
+		if err != nil {
+			return proto.HandshakeResponsePayload{}, fmt.Errorf("malformed handshake response: %w", err)
+		}
+	}
+	if resp.Version < proto.MinProtocolVersion {
+		return proto.HandshakeResponsePayload{}, fmt.Errorf("%w, it speaks protocol version %d but we need %d or newer", ErrRelayTooOld, resp.Version, proto.MinProtocolVersion)
+	}
+	return resp, nil
+}
+
+// Reads relay's notification that we've been paired with a peer, and
+// returns capabilities that relay and peer both support
+func waitForPeer(ctx context.Context, conn *relayConn, want proto.Opcode, relayCaps []string, timeout time.Duration) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	payload, err := proto.ReadExpectedFrameContext(ctx, conn.Conn, want)
+	if err != nil {
+		return nil, err
+	}
+	return pairedCaps(conn, payload, relayCaps)
+}
+
+// Marks conn as paired given relay's pairing notification, and returns
+// capabilities that relay and peer both support
+func pairedCaps(conn *relayConn, payload []byte, relayCaps []string) ([]string, error) {
+	conn.setPaired()
+	paired, err := proto.ParseJSON[proto.PairedPayload](payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed pairing notification: %w", err)
+	}
+	peerCaps := proto.IntersectCapabilities(relayCaps, paired.Capabilities)
+	if !slices.Contains(peerCaps, proto.CapEncryption) {
+		return nil, fmt.Errorf("encryption: %w", ErrUnsupported)
+	}
+	return peerCaps, nil
+}
+
+// Cancels the transfer on conn once ctx is done so that blocked reads and
+// writes return. The returned function stops that and must be called when
+// done with conn.
+func closeOnCancel(ctx context.Context, conn *relayConn) (stop func() bool) {
+	return context.AfterFunc(ctx, conn.cancel)
+}
+
+// Watches for the peer cancelling while we're only writing to conn, since
+// a cancel frame is all they'd send then. If writing fails, the returned
+// function tells whether it's because the peer cancelled.
+func watchCancel(conn *relayConn) (cancelled func() bool) {
+	var peerCancelled bool
+	done := make(chan struct{})
+	conn.Conn.SetReadDeadline(time.Time{})
+	go func() {
+		defer close(done)
+		opcode, _, err := proto.ReadFrame(conn.Conn)
+		peerCancelled = err == nil && opcode == proto.OpcodeCancel
+	}()
+	return func() bool {
+		// A cancel frame would already be here, no need to wait long
+		conn.Conn.SetReadDeadline(time.Now().Add(time.Second))
+		<-done
+		return peerCancelled
+	}
+}
+
+// If ctx was cancelled, that's the reason behind err
+func ctxErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Reports progress as data is written through it
+type progressWriter struct {
+	w     io.Writer
+	done  int64
+	total int64
+	fn    func(done, total int64)
+}
+
+func newProgressWriter(w io.Writer, done, total int64, fn func(done, total int64)) io.Writer {
+	if fn == nil {
+		return w
+	}
+	fn(done, total)
+	return &progressWriter{w: w, done: done, total: total, fn: fn}
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.done += int64(n)
+	done := pw.done
+	if pw.total >= 0 {
+		done = min(done, pw.total) // folders also stream a bit of metadata
+	}
+	pw.fn(done, pw.total)
+	return n, err
+}
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/diwasrimal/bullet/pkg/pake"
+	"github.com/diwasrimal/bullet/pkg/proto"
+	"github.com/diwasrimal/bullet/pkg/secure"
+)
+
+// How long to try connecting directly with the peer if Options doesn't say
+const defaultDirectTimeout = 2 * time.Second
+
+// A direct connection with the peer, with the key exchange done over it
+type directConn struct {
+	id    string
+	conn  *relayConn
+	sconn *secure.Conn
+}
+
+// Tries connecting directly with the peer, who's doing the same on their
+// end. Both of us listen and dial each other's addresses, exchanged through
+// sconn which goes through the relay, and the receiver picks whichever
+// connection completes the key exchange first. Returns nil if none did
+// within the timeout, so that we keep going through the relay. Errors are
+// only returned if sconn itself fails.
+//
+// A peer that sends no addresses, because it can't listen or doesn't want
+// to connect directly, doesn't dial either and both of us skip the attempt.
+func connectDirect(ctx context.Context, sconn *secure.Conn, role pake.Role, shareCode string, observedAddr string, opts Options) (*directConn, error) {
+	timeout := cmp.Or(opts.DirectTimeout, defaultDirectTimeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	attempt := &directAttempt{
+		role:        role,
+		shareCode:   shareCode,
+		timeout:     timeout,
+		established: make(chan *directConn),
+		stop:        make(chan struct{}),
+	}
+	defer attempt.close()
+
+	// Tell the peer where we can be reached, and hear the same from them
+	token, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	if !opts.NoDirect {
+		if ln, err := net.Listen("tcp", ":0"); err == nil {
+			attempt.ln = ln
+			addrs = candidateAddrs(ln.Addr().(*net.TCPAddr).Port, observedAddr)
+			go attempt.accept(token)
+		}
+	}
+	_, err = proto.WriteFrame(sconn, proto.OpcodeCandidates, proto.JSONToBytes(proto.CandidatesPayload{
+		Addrs: addrs,
+		Token: token,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("sending addresses to peer: %w", err)
+	}
+	payload, err := proto.ReadExpectedFrame(sconn, proto.OpcodeCandidates)
+	if err != nil {
+		return nil, fmt.Errorf("reading peer's addresses: %w", err)
+	}
+	peer, err := proto.ParseJSON[proto.CandidatesPayload](payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed peer's addresses: %w", err)
+	}
+	if len(addrs) == 0 || len(peer.Addrs) == 0 {
+		return nil, nil
+	}
+	for _, addr := range peer.Addrs {
+		go attempt.dial(ctx, addr, peer.Token)
+	}
+
+	// Receiver picks the first connection that works, and sender
+	// waits for that one since they might have a different first
+	if role == pake.RoleReceiver {
+		var chosen proto.DirectChosenPayload
+		select {
+		case dc := <-attempt.established:
+			chosen.ID = dc.id
+			attempt.keep(dc)
+		case <-ctx.Done():
+		}
+		_, err = proto.WriteFrame(sconn, proto.OpcodeDirectChosen, proto.JSONToBytes(chosen))
+		if err != nil {
+			return nil, fmt.Errorf("telling peer about direct connection: %w", err)
+		}
+		if attempt.kept == nil {
+			opts.logf("Couldn't connect directly with sender\n")
+			return nil, nil
+		}
+		opts.logf("Connected directly with sender at %s\n", attempt.kept.conn.RemoteAddr())
+		return attempt.kept, nil
+	}
+
+	payload, err = proto.ReadExpectedFrame(sconn, proto.OpcodeDirectChosen)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for peer to pick a direct connection: %w", err)
+	}
+	chosen, err := proto.ParseJSON[proto.DirectChosenPayload](payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed direct connection pick: %w", err)
+	}
+	if chosen.ID == "" {
+		opts.logf("Couldn't connect directly with receiver\n")
+		return nil, nil
+	}
+
+	// Receiver has finished the key exchange on it, so we're about to as well
+	grace := time.NewTimer(timeout)
+	defer grace.Stop()
+	for {
+		select {
+		case dc := <-attempt.established:
+			if dc.id == chosen.ID {
+				attempt.keep(dc)
+				opts.logf("Connected directly with receiver at %s\n", dc.conn.RemoteAddr())
+				return dc, nil
+			}
+			dc.conn.Close()
+		case <-grace.C:
+			return nil, fmt.Errorf("peer picked a direct connection we don't have")
+		}
+	}
+}
+
+// Tracks connections being attempted with the peer
+type directAttempt struct {
+	role        pake.Role
+	shareCode   string
+	timeout     time.Duration // for each connection to complete the key exchange
+	ln          net.Listener
+	established chan *directConn
+	stop        chan struct{} // closed once we're done with the attempt
+
+	mu     sync.Mutex
+	conns  []net.Conn // all connections attempted, closed unless kept
+	kept   *directConn
+	closed bool
+}
+
+// Accepts connections from the peer, who must present token
+func (a *directAttempt) accept(token string) {
+	for {
+		conn, err := a.ln.Accept()
+		if err != nil {
+			return
+		}
+		if !a.track(conn) {
+			return
+		}
+		go func() {
+			conn.SetDeadline(time.Now().Add(a.timeout))
+			payload, err := proto.ReadExpectedFrame(conn, proto.OpcodeDirectHello)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			hello, err := proto.ParseJSON[proto.DirectHelloPayload](payload)
+			if err != nil || hello.Token != token {
+				conn.Close()
+				return
+			}
+			a.establish(conn, hello.ID)
+		}()
+	}
+}
+
+// Dials the peer at addr, presenting their token
+func (a *directAttempt) dial(ctx context.Context, addr string, token string) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return
+	}
+	if !a.track(conn) {
+		return
+	}
+	id, err := randomID()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Now().Add(a.timeout))
+	_, err = proto.WriteFrame(conn, proto.OpcodeDirectHello, proto.JSONToBytes(proto.DirectHelloPayload{
+		Token: token,
+		ID:    id,
+	}))
+	if err != nil {
+		conn.Close()
+		return
+	}
+	a.establish(conn, id)
+}
+
+// Runs the key exchange again over a direct connection, so that we know
+// it's really with the peer, and hands it out if it works
+func (a *directAttempt) establish(conn net.Conn, id string) {
+	rc := &relayConn{Conn: conn, paired: true}
+	sconn, err := secure.Establish(rc, a.role, a.shareCode)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	select {
+	case a.established <- &directConn{id: id, conn: rc, sconn: sconn}:
+	case <-a.stop:
+		conn.Close()
+	}
+}
+
+// Remembers conn so that it's closed later, unless we're already done
+func (a *directAttempt) track(conn net.Conn) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		conn.Close()
+		return false
+	}
+	a.conns = append(a.conns, conn)
+	return true
+}
+
+// Marks dc as the connection to use, so that it isn't closed
+func (a *directAttempt) keep(dc *directConn) {
+	a.mu.Lock()
+	a.kept = dc
+	a.mu.Unlock()
+}
+
+// Stops listening and closes all connections but the kept one
+func (a *directAttempt) close() {
+	if a.ln != nil {
+		a.ln.Close()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	close(a.stop)
+	for _, conn := range a.conns {
+		if a.kept == nil || conn != a.kept.conn.Conn {
+			conn.Close()
+		}
+	}
+}
+
+// Addresses of all our interfaces with port, along with
+// the address relay sees us at in case we aren't behind NAT
+func candidateAddrs(port int, observedAddr string) []string {
+	var ips []string
+	if ifaddrs, err := net.InterfaceAddrs(); err == nil {
+		for _, ifaddr := range ifaddrs {
+			ipnet, ok := ifaddr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLinkLocalUnicast() { // would need a zone to be dialed
+				continue
+			}
+			ips = append(ips, ipnet.IP.String())
+		}
+	}
+	if host, _, err := net.SplitHostPort(observedAddr); err == nil && !slices.Contains(ips, host) {
+		ips = append(ips, host)
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, fmt.Sprint(port))
+	}
+	return addrs
+}
+
+func randomID() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/diwasrimal/bullet/pkg/proto"
+	"github.com/diwasrimal/bullet/pkg/secure"
+)
+
+// Whether the file is being sent to several receivers
+func fanningOut(opts Options) bool {
+	return opts.Receivers != 0 && opts.Receivers != 1
+}
+
+// Sends to every receiver that shows up on the share code, until there
+// have been opts.Receivers of them. Each receiver agrees on a different
+// key with us, so the relay tells us about them on the connection we
+// registered with and we serve each on a new connection. Transfers with
+// receivers are reported through opts.OnReceiver, returned result sums
+// them up. Running out of time waiting for more receivers, or the share
+// code expiring, is only an error if no receiver showed up.
+func fanOut(ctx context.Context, relayAddr string, channel, secret string, meta Meta, opts Options, open opener) (Result, error) {
+	result := Result{Meta: meta}
+	conn, _, shareCode, err := register(ctx, relayAddr, channel, secret, meta, opts)
+	if err != nil {
+		return result, ctxErr(ctx, err)
+	}
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+	result.ShareCode = shareCode
+	channel, _, _ = proto.SplitShareCode(shareCode) // relay might have picked it
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	joined := 0
+	for opts.Receivers < 0 || joined < opts.Receivers {
+		id, err := waitForReceiver(ctx, conn, opts)
+		if err != nil {
+			wg.Wait()
+			var relayErr *proto.ErrorPayload
+			switch {
+			case ctx.Err() != nil:
+				return result, ctx.Err()
+			case joined > 0 && errors.Is(err, ErrTimeout):
+			case joined > 0 && errors.As(err, &relayErr) && relayErr.Code == proto.ErrShareCodeExpired:
+			default:
+				return result, fmt.Errorf("waiting for receiver: %w", err)
+			}
+			return result, nil
+		}
+		joined++
+		n := joined
+		opts.logf("Receiver %d connected\n", n)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := serveReceiver(ctx, relayAddr, channel, id, shareCode, meta, receiverOptions(opts, n), open)
+			mu.Lock()
+			result.Transferred += r.Transferred
+			if err == nil {
+				result.Receivers++
+				result.SHA256 = r.SHA256
+			}
+			mu.Unlock()
+			if errors.Is(err, secure.ErrKeyMismatch) {
+				// Lets the relay invalidate the share code if someone keeps
+				// guessing it, older relays just ignore this. Written through
+				// conn so that it doesn't get mixed up with other writes, or
+				// disturb the read waiting for the next receiver.
+				proto.WriteFrame(conn, proto.OpcodeWrongPeer, proto.JSONToBytes(proto.WrongPeerPayload{
+					ID: id,
+				}))
+			}
+			if opts.OnReceiver != nil {
+				opts.OnReceiver(n, r, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	return result, nil
+}
+
+// Reads relay's notice that a receiver is waiting to be served,
+// returning the ID it was given
+func waitForReceiver(ctx context.Context, conn *relayConn, opts Options) (string, error) {
+	ctx, cancel := withTimeout(ctx, opts.WaitTimeout)
+	defer cancel()
+	payload, err := proto.ReadExpectedFrameContext(ctx, conn.Conn, proto.OpcodeReceiverJoined)
+	if err != nil {
+		return "", err
+	}
+	joined, err := proto.ParseJSON[proto.ReceiverJoinedPayload](payload)
+	if err != nil {
+		return "", fmt.Errorf("malformed receiver notice: %w", err)
+	}
+	return joined.ID, nil
+}
+
+// Connects with the relay again to serve the receiver it named id
+func serveReceiver(ctx context.Context, relayAddr string, channel, id, shareCode string, meta Meta, opts Options, open opener) (Result, error) {
+	result := Result{ShareCode: shareCode, Meta: meta}
+	hctx, cancel := withTimeout(ctx, opts.HandshakeTimeout)
+	defer cancel()
+	conn, relayCaps, err := connect(hctx, relayAddr, opts)
+	if err != nil {
+		return result, ctxErr(ctx, err)
+	}
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+
+	_, err = proto.WriteFrameContext(hctx, conn.Conn, proto.OpcodeServeReceiver, proto.JSONToBytes(proto.ServeReceiverPayload{
+		Channel: channel,
+		ID:      id,
+	}))
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("during serve request: %w", err))
+	}
+	peerCaps, err := waitForPeer(hctx, conn, proto.OpcodeCanStartSending, relayCaps, 0)
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("getting paired with receiver: %w", err))
+	}
+	src, stream := open()
+	return transfer(ctx, conn, peerCaps, result, opts, src, stream)
+}
+
+// Options for serving the nth receiver, messages are tagged with n and
+// progress isn't reported since it can't tell receivers apart
+func receiverOptions(opts Options, n int) Options {
+	logf := opts.Logf
+	if logf != nil {
+		opts.Logf = func(format string, a ...any) {
+			logf("Receiver %d: "+format, append([]any{n}, a...)...)
+		}
+	}
+	opts.Progress = nil
+	return opts
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diwasrimal/bullet/pkg/proto"
+)
+
+// Multicast group senders announce themselves on, when transferring on
+// the local network without a relay
+var lanGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 42, 42), Port: 3031}
+
+const lanAnnounceInterval = time.Second
+
+// Capabilities when transferring on the local network, connection
+// with the peer is already direct so there's no need to try for one,
+// and there's no relay to fan out through
+var lanCapabilities = slices.DeleteFunc(slices.Clone(proto.Capabilities), func(c string) bool {
+	return c == proto.CapDirect || c == proto.CapFanout
+})
+
+// Waits for a receiver on the local network, announcing the channel until
+// one connects. We play the relay's part for them, so they go through the
+// same handshake and recv request as with a relay.
+func pairOnLAN(ctx context.Context, channel, secret string, opts Options) (conn *relayConn, peerCaps []string, shareCode string, err error) {
+	if channel == "" {
+		// Anyone on the network can see the channel, but it shouldn't
+		// be predictable from earlier transfers either
+		n, err := rand.Int(rand.Reader, big.NewInt(1000))
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("generating share code: %w", err)
+		}
+		channel = n.String()
+	}
+	shareCode = channel + "-" + secret
+
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("listening for receiver: %w", err)
+	}
+	defer ln.Close()
+	if opts.OnShareCode != nil {
+		opts.OnShareCode(shareCode, 0)
+	}
+
+	ctx, cancel := withTimeout(ctx, opts.WaitTimeout)
+	defer cancel()
+	context.AfterFunc(ctx, func() { ln.Close() })
+	go announce(ctx, channel, ln.Addr().(*net.TCPAddr).Port)
+
+	for {
+		netConn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, shareCode, fmt.Errorf("waiting for receiver: %w", context.Cause(ctx))
+			}
+			return nil, nil, shareCode, fmt.Errorf("waiting for receiver: %w", err)
+		}
+		peerCaps, err := answerReceiver(ctx, netConn, channel, opts.HandshakeTimeout)
+		if err != nil {
+			opts.logf("Ignoring connection from %s: %v\n", netConn.RemoteAddr(), err)
+			netConn.Close()
+			continue
+		}
+		return &relayConn{Conn: netConn, paired: true}, peerCaps, shareCode, nil
+	}
+}
+
+// Sends announcements for channel until ctx is done
+func announce(ctx context.Context, channel string, port int) {
+	udpConn, err := net.DialUDP("udp4", nil, lanGroup)
+	if err != nil {
+		return
+	}
+	defer udpConn.Close()
+
+	var datagram bytes.Buffer
+	proto.WriteFrame(&datagram, proto.OpcodeLANAnnounce, proto.JSONToBytes(proto.LANAnnouncePayload{
+		Channel: channel,
+		Port:    port,
+	}))
+	ticker := time.NewTicker(lanAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		udpConn.Write(datagram.Bytes())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Completes the handshake and recv request of a receiver who found us,
+// like the relay would have. Returns capabilities we both support.
+func answerReceiver(ctx context.Context, conn net.Conn, channel string, timeout time.Duration) ([]string, error) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	payload, err := proto.ReadExpectedFrameContext(ctx, conn, proto.OpcodeHandshakeRequest)
+	if err != nil {
+		return nil, fmt.Errorf("reading handshake: %w", err)
+	}
+	req, err := proto.ParseJSON[proto.HandshakeRequestPayload](payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed handshake: %w", err)
+	}
+	resp := proto.HandshakeResponsePayload{
+		Version:      min(req.Version, proto.ProtocolVersion),
+		MinVersion:   proto.MinProtocolVersion,
+		Capabilities: proto.IntersectCapabilities(req.Capabilities, lanCapabilities),
+	}
+	if resp.Version < proto.MinProtocolVersion {
+		proto.WriteFrameContext(ctx, conn, proto.OpcodeVersionMismatch, proto.JSONToBytes(resp))
+		return nil, fmt.Errorf("%w, receiver speaks protocol version %d", ErrClientTooOld, req.Version)
+	}
+	if _, err := proto.WriteFrameContext(ctx, conn, proto.OpcodeHandshakeResponse, proto.JSONToBytes(resp)); err != nil {
+		return nil, fmt.Errorf("during handshake: %w", err)
+	}
+
+	payload, err = proto.ReadExpectedFrameContext(ctx, conn, proto.OpcodeFileRecvRequest)
+	if err != nil {
+		return nil, fmt.Errorf("reading recv request: %w", err)
+	}
+	recvReq, err := proto.ParseJSON[proto.FileRecvRequestPayload](payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recv request: %w", err)
+	}
+	if !strings.EqualFold(recvReq.Channel, channel) {
+		proto.WriteError(conn, proto.ErrShareCodeNotFound, "no sender is waiting on share code channel %q", recvReq.Channel)
+		return nil, errors.New("receiver wants a different share code")
+	}
+	_, err = proto.WriteFrameContext(ctx, conn, proto.OpcodeFileRecvResponse, proto.JSONToBytes(proto.PairedPayload{
+		Capabilities: lanCapabilities,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("notifying receiver: %w", err)
+	}
+	return resp.Capabilities, nil
+}
+
+// Listens for announcements until a sender with channel shows up,
+// and returns the address to connect with them at
+func discoverOnLAN(ctx context.Context, channel string) (string, error) {
+	udpConn, err := net.ListenMulticastUDP("udp4", nil, lanGroup)
+	if err != nil {
+		return "", fmt.Errorf("listening for senders: %w", err)
+	}
+	defer udpConn.Close()
+	stop := context.AfterFunc(ctx, func() { udpConn.Close() })
+	defer stop()
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", fmt.Errorf("looking for sender on the local network: %w", context.Cause(ctx))
+			}
+			return "", fmt.Errorf("looking for sender on the local network: %w", err)
+		}
+		opcode, payload, err := proto.ReadFrame(bytes.NewReader(buf[:n]))
+		if err != nil || opcode != proto.OpcodeLANAnnounce {
+			continue
+		}
+		announcement, err := proto.ParseJSON[proto.LANAnnouncePayload](payload)
+		if err != nil || announcement.Channel != channel {
+			continue
+		}
+		return net.JoinHostPort(from.IP.String(), strconv.Itoa(announcement.Port)), nil
+	}
+}
@@ -0,0 +1,396 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+
+	"github.com/diwasrimal/bullet/pkg/archive"
+	"github.com/diwasrimal/bullet/pkg/pake"
+	"github.com/diwasrimal/bullet/pkg/proto"
+	"github.com/diwasrimal/bullet/pkg/ratelimit"
+	"github.com/diwasrimal/bullet/pkg/secure"
+	"github.com/diwasrimal/bullet/pkg/utils"
+)
+
+// Receive gets paired with the sender using shareCode and receives their
+// file, or gets it from the relay's storage if the sender uploaded it
+// there. Once the file's details are known, accept is called to decide
+// where it should be written, returning an error declines the file.
+// Folders are handled by opts.AcceptFolder instead.
+//
+// If the writer returned by accept is an [io.ReadWriteSeeker] that already
+// holds part of the file, like a partially received file opened for reading
+// and writing, only the rest of the file is received if the part matches
+// sender's file. Writers that can be truncated, like [os.File], are
+// truncated if it doesn't match.
+func Receive(ctx context.Context, relayAddr string, shareCode string, accept func(meta Meta) (io.Writer, error), opts Options) (Result, error) {
+	shareCode = proto.NormalizeShareCode(shareCode)
+	result := Result{ShareCode: shareCode}
+	opts.limiter = ratelimit.New(opts.RateLimit)
+
+	// Only the channel part of share code is given to the relay
+	channel, secret, err := proto.SplitShareCode(shareCode)
+	if err != nil {
+		return result, err
+	}
+
+	// Ask the relay to pair us with the sender, within the handshake timeout.
+	// On the local network, the sender answers for the relay once found.
+	hctx, cancel := withTimeout(ctx, opts.HandshakeTimeout)
+	defer cancel()
+	relayOpts := opts
+	if opts.LAN {
+		relayAddr, err = discoverOnLAN(hctx, channel)
+		if err != nil {
+			return result, ctxErr(ctx, err)
+		}
+		result.Direct = true
+		relayOpts.TLS, relayOpts.Token = nil, "" // sender isn't a relay, keep the token to ourselves
+	}
+	conn, relayCaps, err := connect(hctx, relayAddr, relayOpts)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+
+	// Do file recv request
+	_, err = proto.WriteFrameContext(
+		hctx,
+		conn.Conn,
+		proto.OpcodeFileRecvRequest,
+		proto.JSONToBytes(proto.FileRecvRequestPayload{
+			Channel: channel,
+		}),
+	)
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("during recv file request: %w", err))
+	}
+
+	// Optional features are only used if relay and sender both support them.
+	// Relay pairs us right away if the sender is there, or offers us their
+	// upload if they stored it instead.
+	opcode, payload, err := proto.ReadExpectedFramesContext(hctx, conn.Conn, proto.OpcodeFileRecvResponse, proto.OpcodeStoredFile)
+	if err != nil {
+		return result, ctxErr(ctx, err)
+	}
+	if opcode == proto.OpcodeStoredFile {
+		return fetch(ctx, conn, secret, payload, result, accept, opts)
+	}
+	peerCaps, err := pairedCaps(conn, payload, relayCaps)
+	if err != nil {
+		return result, err
+	}
+
+	// We have been paired with the sender, agree on a key with them
+	// and get the file details through the encrypted channel
+	conn.timeout = opts.IdleTimeout
+	sconn, err := secure.Establish(conn, pake.RoleReceiver, shareCode)
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("establishing secure channel with sender: %w", err))
+	}
+
+	// Try to get off the relay, everything from here on goes
+	// through a direct connection with the peer if it works
+	if slices.Contains(peerCaps, proto.CapDirect) {
+		dc, err := connectDirect(ctx, sconn, pake.RoleReceiver, shareCode, conn.observedAddr, opts)
+		if err != nil {
+			return result, ctxErr(ctx, err)
+		}
+		if dc != nil {
+			conn.Close()
+			conn, sconn = dc.conn, dc.sconn
+			conn.timeout = opts.IdleTimeout
+			defer conn.Close()
+			defer closeOnCancel(ctx, conn)()
+			result.Direct = true
+		}
+	}
+	if !result.Direct {
+		opts.logf("Transferring through relay\n")
+	}
+	return receive(ctx, sconn, result, peerCaps, accept, opts)
+}
+
+// Receives what the sender offers on sconn, once we're talking to them
+// end-to-end encrypted
+func receive(ctx context.Context, sconn io.ReadWriter, result Result, peerCaps []string, accept func(meta Meta) (io.Writer, error), opts Options) (Result, error) {
+	payload, err := proto.ReadExpectedFrame(sconn, proto.OpcodeFileOffer)
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("reading file details: %w", err))
+	}
+	fileOffer, err := proto.ParseJSON[proto.FileOfferPayload](payload)
+	if err != nil {
+		return result, fmt.Errorf("malformed file details: %w", err)
+	}
+	result.Meta = Meta{
+		Name:  fileOffer.Filename,
+		Size:  fileOffer.Filesize,
+		IsDir: fileOffer.IsDir,
+		Files: fileOffer.Files,
+	}
+	if fileOffer.Streamed {
+		result.Meta.Size = -1
+	}
+
+	if result.Meta.IsDir {
+		return receiveFolder(ctx, sconn, fileOffer.Codec, result, peerCaps, opts)
+	}
+	if fileOffer.Manifest != nil {
+		result.Meta.Manifest = fileOffer.Manifest
+		return receiveFiles(ctx, sconn, fileOffer.Codec, result, peerCaps, opts)
+	}
+	w, err := accept(result.Meta)
+	if err != nil {
+		return result, decline(sconn, peerCaps, err)
+	}
+
+	// A writer already holding part of the file is likely a partially
+	// received file from an earlier attempt, so try resuming it
+	var ready proto.ReadyToRecievePayload
+	digest := sha256.New()
+	partial, isPartial := w.(io.ReadWriteSeeker)
+	if t, ok := w.(interface{ Truncate(int64) error }); ok && isPartial && result.Stored {
+		// Stored uploads are always read from the start
+		if err := t.Truncate(0); err != nil {
+			return result, fmt.Errorf("truncating partial file: %w", err)
+		}
+	}
+	if isPartial && !fileOffer.Streamed && slices.Contains(peerCaps, proto.CapResume) {
+		ready.Offset, ready.PrefixHash, err = partialPrefix(partial, result.Meta.Size, digest)
+		if err != nil {
+			return result, fmt.Errorf("reading partial file: %w", err)
+		}
+	}
+
+	// Now notify sender that we are ready to receive the file, they tell
+	// us where they start from since our partial file might not match theirs
+	_, err = proto.WriteFrame(sconn, proto.OpcodeReadyToRecieve, proto.JSONToBytes(ready))
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("notifying sender: %w", err))
+	}
+	payload, err = proto.ReadExpectedFrame(sconn, proto.OpcodeStreamStart)
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("waiting for sender to start: %w", err))
+	}
+	start, err := proto.ParseJSON[proto.StreamStartPayload](payload)
+	if err != nil {
+		return result, fmt.Errorf("malformed stream start: %w", err)
+	}
+	if start.Offset != 0 && start.Offset != ready.Offset {
+		return result, fmt.Errorf("sender wants to start from %d, but we have %d bytes", start.Offset, ready.Offset)
+	}
+	if ready.Offset > 0 {
+		if start.Offset == 0 {
+			opts.logf("Partial file doesn't match sender's file, receiving from the start\n")
+			digest.Reset()
+		} else {
+			opts.logf("Resuming from %s\n", utils.ReadableSize(start.Offset))
+		}
+		// Drop anything past where the sender continues from
+		if t, ok := w.(interface{ Truncate(int64) error }); ok {
+			if err := t.Truncate(start.Offset); err != nil {
+				return result, fmt.Errorf("truncating partial file: %w", err)
+			}
+		}
+		if _, err := partial.Seek(start.Offset, io.SeekStart); err != nil {
+			return result, fmt.Errorf("seeking partial file: %w", err)
+		}
+	}
+	result.Offset = start.Offset
+
+	// And receive the file into destination, hashing it along the way.
+	// Data of unknown size comes in chunks until sender marks the end.
+	src, err := newDataReader(ratelimit.NewReader(sconn, opts.limiter), fileOffer.Codec, fileOffer.Streamed)
+	if err != nil {
+		return result, ctxErr(ctx, err)
+	}
+	dst := newProgressWriter(io.MultiWriter(w, digest), result.Offset, result.Meta.Size, opts.Progress)
+	if fileOffer.Streamed {
+		result.Transferred, err = io.Copy(dst, src)
+		result.Meta.Size = result.Transferred
+	} else {
+		result.Transferred, err = io.CopyN(dst, src, result.Meta.Size-result.Offset)
+	}
+	if err == nil {
+		err = src.Close()
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = ErrIncomplete
+		}
+		return result, ctxErr(ctx, fmt.Errorf("receiving file: %w", err))
+	}
+	result.SHA256, err = verifyDigest(sconn, digest, peerCaps)
+	return result, ctxErr(ctx, err)
+}
+
+// Receives a folder streamed as an archive into a directory
+// chosen by opts.AcceptFolder
+func receiveFolder(ctx context.Context, sconn io.ReadWriter, codec string, result Result, peerCaps []string, opts Options) (Result, error) {
+	if opts.AcceptFolder == nil {
+		return result, decline(sconn, peerCaps, errors.New("receiving folders is not enabled"))
+	}
+	dirpath, err := opts.AcceptFolder(result.Meta)
+	if err != nil {
+		return result, decline(sconn, peerCaps, err)
+	}
+
+	// Folders can't be resumed, so we don't care about sender's offset
+	_, err = proto.WriteFrame(sconn, proto.OpcodeReadyToRecieve, proto.JSONToBytes(proto.ReadyToRecievePayload{}))
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("notifying sender: %w", err))
+	}
+	if _, err := proto.ReadExpectedFrame(sconn, proto.OpcodeStreamStart); err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("waiting for sender to start: %w", err))
+	}
+
+	src, err := newDataReader(ratelimit.NewReader(sconn, opts.limiter), codec, false)
+	if err != nil {
+		return result, ctxErr(ctx, err)
+	}
+	digest := sha256.New()
+	tee := io.TeeReader(src, newProgressWriter(digest, 0, result.Meta.Size, opts.Progress))
+	files, size, err := archive.Extract(tee, dirpath)
+	result.Transferred = size
+	if err == nil {
+		err = src.Close()
+	}
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("receiving folder: %w", err))
+	}
+	if size != result.Meta.Size || files != result.Meta.Files {
+		return result, fmt.Errorf("%w, got (%d/%d) files, (%d/%d) bytes", ErrIncomplete, files, result.Meta.Files, size, result.Meta.Size)
+	}
+	result.SHA256, err = verifyDigest(sconn, digest, peerCaps)
+	return result, ctxErr(ctx, err)
+}
+
+// Receives the files picked by opts.AcceptFiles out of several offered
+// together, into the directory it chose
+func receiveFiles(ctx context.Context, sconn io.ReadWriter, codec string, result Result, peerCaps []string, opts Options) (Result, error) {
+	if opts.AcceptFiles == nil {
+		return result, decline(sconn, peerCaps, errors.New("receiving several files is not enabled"))
+	}
+	dirpath, selected, err := opts.AcceptFiles(result.Meta)
+	if err != nil {
+		return result, decline(sconn, peerCaps, err)
+	}
+	if err := checkSelection(selected, len(result.Meta.Manifest)); err != nil {
+		return result, decline(sconn, peerCaps, fmt.Errorf("picking files: %w", err))
+	}
+	want := make([]proto.ManifestEntry, len(selected))
+	result.Meta.Size, result.Meta.Files = 0, len(selected)
+	for i, idx := range selected {
+		want[i] = result.Meta.Manifest[idx]
+		result.Meta.Size += want[i].Size
+	}
+
+	// Stored uploads hold every file, the ones we didn't pick are skipped
+	var keep []bool
+	streamedSize := result.Meta.Size
+	if result.Stored {
+		want, keep = result.Meta.Manifest, make([]bool, len(result.Meta.Manifest))
+		for _, idx := range selected {
+			keep[idx] = true
+		}
+		streamedSize = 0
+		for _, file := range want {
+			streamedSize += file.Size
+		}
+	}
+
+	_, err = proto.WriteFrame(sconn, proto.OpcodeReadyToRecieve, proto.JSONToBytes(proto.ReadyToRecievePayload{
+		Selected: selected,
+	}))
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("notifying sender: %w", err))
+	}
+	if _, err := proto.ReadExpectedFrame(sconn, proto.OpcodeStreamStart); err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("waiting for sender to start: %w", err))
+	}
+
+	src, err := newDataReader(ratelimit.NewReader(sconn, opts.limiter), codec, false)
+	if err != nil {
+		return result, ctxErr(ctx, err)
+	}
+	digest := sha256.New()
+	tee := io.TeeReader(src, newProgressWriter(digest, 0, streamedSize, opts.Progress))
+	result.Transferred, err = archive.ExtractFiles(tee, dirpath, want, keep)
+	if err == nil {
+		err = src.Close()
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = ErrIncomplete
+		}
+		return result, ctxErr(ctx, fmt.Errorf("receiving files: %w", err))
+	}
+	result.SHA256, err = verifyDigest(sconn, digest, peerCaps)
+	return result, ctxErr(ctx, err)
+}
+
+// Tells the sender we turned down their offer because of err, and returns
+// err. Senders that can't be told only see us hang up.
+func decline(sconn io.Writer, peerCaps []string, err error) error {
+	if slices.Contains(peerCaps, proto.CapDecline) {
+		proto.WriteFrame(sconn, proto.OpcodeDecline, nil)
+	}
+	return err
+}
+
+// Checks if w holds part of a file of given size, and returns how much of
+// it it has along with hash of that part. The hash is fed into digest.
+// w is left positioned at the start, and emptied if possible, if it doesn't
+// hold a partial file.
+func partialPrefix(w io.ReadWriteSeeker, size int64, digest hash.Hash) (offset int64, prefixHash []byte, err error) {
+	have, err := w.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, nil, nil // not really seekable, like a pipe
+	}
+	if _, err := w.Seek(0, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+	if have == 0 {
+		return 0, nil, nil
+	}
+	if have >= size {
+		if t, ok := w.(interface{ Truncate(int64) error }); ok {
+			return 0, nil, t.Truncate(0)
+		}
+		return 0, nil, nil
+	}
+	prefixHash, err = hashPrefix(digest, w, have)
+	if err != nil {
+		return 0, nil, err
+	}
+	return have, prefixHash, nil
+}
+
+// Reads sender's trailing hash and checks it against the hash of received
+// data, returns the hex encoded hash. Returns an empty hash without error
+// if sender doesn't send one.
+func verifyDigest(r io.Reader, digest hash.Hash, peerCaps []string) (string, error) {
+	if !slices.Contains(peerCaps, proto.CapDigest) {
+		return "", nil
+	}
+	payload, err := proto.ReadExpectedFrame(r, proto.OpcodeDigest)
+	if err != nil {
+		return "", fmt.Errorf("reading sender's hash: %w", err)
+	}
+	want, err := proto.ParseJSON[proto.DigestPayload](payload)
+	if err != nil {
+		return "", fmt.Errorf("malformed sender's hash: %w", err)
+	}
+	have := hex.EncodeToString(digest.Sum(nil))
+	if have != want.SHA256 {
+		return "", fmt.Errorf("%w, sender has %s but received data hashes to %s", ErrDigestMismatch, want.SHA256, have)
+	}
+	return have, nil
+}
@@ -0,0 +1,479 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/diwasrimal/bullet/pkg/archive"
+	"github.com/diwasrimal/bullet/pkg/pake"
+	"github.com/diwasrimal/bullet/pkg/proto"
+	"github.com/diwasrimal/bullet/pkg/ratelimit"
+	"github.com/diwasrimal/bullet/pkg/secure"
+	"github.com/diwasrimal/bullet/pkg/utils"
+	"github.com/diwasrimal/bullet/pkg/wordcode"
+)
+
+// Send registers with the relay, waits for a receiver and streams meta.Size
+// bytes read from r to them. The share code is given to opts.OnShareCode
+// as soon as it's known. If r is an [io.ReadSeeker], a receiver with a
+// partial copy of the file only gets the rest of it.
+//
+// If meta.Size is negative, like when r is a pipe, everything up to EOF
+// is sent in chunks and the receiver learns the size at the end.
+func Send(ctx context.Context, relayAddr string, r io.Reader, meta Meta, opts Options) (Result, error) {
+	meta.IsDir = false
+	meta.Files = 0
+	meta.Manifest = nil
+	open := func() (io.Reader, streamer) {
+		return r, func(w io.Writer, _ []int) (int64, error) {
+			return io.Copy(w, r)
+		}
+	}
+
+	// Each receiver reads the file on its own when fanning out
+	if fanningOut(opts) {
+		if meta.Size < 0 {
+			return Result{Meta: meta}, errors.New("sending to several receivers needs data of known size")
+		}
+		ra, ok := r.(io.ReaderAt)
+		if !ok {
+			return Result{Meta: meta}, errors.New("sending to several receivers needs a file that can be read again")
+		}
+		open = func() (io.Reader, streamer) {
+			r := io.NewSectionReader(ra, 0, meta.Size)
+			return r, func(w io.Writer, _ []int) (int64, error) {
+				return io.Copy(w, r)
+			}
+		}
+	}
+	return send(ctx, relayAddr, meta, opts, open)
+}
+
+// SendFolder is like [Send] but streams the folder at root as an archive.
+func SendFolder(ctx context.Context, relayAddr string, root string, opts Options) (Result, error) {
+	manifest, err := archive.Scan(root)
+	if err != nil {
+		return Result{}, fmt.Errorf("reading folder: %w", err)
+	}
+	meta := Meta{
+		Name:  filepath.Base(root),
+		Size:  manifest.Size,
+		IsDir: true,
+		Files: manifest.Files,
+	}
+	if abspath, err := filepath.Abs(root); err == nil {
+		meta.Name = filepath.Base(abspath) // so that "." has a sensible name
+	}
+	return send(ctx, relayAddr, meta, opts, func() (io.Reader, streamer) {
+		return nil, func(w io.Writer, _ []int) (int64, error) {
+			return archive.Write(w, root)
+		}
+	})
+}
+
+// SendFiles is like [Send] but offers the regular files at paths together
+// under a single share code. The receiver picks which of them it wants,
+// and those are streamed one after another. Files are named by their base
+// names, which must be unique.
+func SendFiles(ctx context.Context, relayAddr string, paths []string, opts Options) (Result, error) {
+	meta := Meta{Name: fmt.Sprintf("%d files", len(paths)), Files: len(paths)}
+	names := make(map[string]bool)
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return Result{Meta: meta}, err
+		}
+		if !info.Mode().IsRegular() {
+			return Result{Meta: meta}, fmt.Errorf("%s is not a regular file", p)
+		}
+		name := filepath.Base(p)
+		if names[name] {
+			return Result{Meta: meta}, fmt.Errorf("several files are named %q", name)
+		}
+		names[name] = true
+		meta.Manifest = append(meta.Manifest, proto.ManifestEntry{Name: name, Size: info.Size()})
+		meta.Size += info.Size()
+	}
+	return send(ctx, relayAddr, meta, opts, func() (io.Reader, streamer) {
+		return nil, func(w io.Writer, selected []int) (int64, error) {
+			picked := make([]string, len(selected))
+			for i, idx := range selected {
+				picked[i] = paths[idx]
+			}
+			return archive.WriteFiles(w, picked)
+		}
+	})
+}
+
+// Opens what's being sent, once for each receiver. src is only used for
+// resuming, and may be nil.
+type opener func() (src io.Reader, stream streamer)
+
+// Writes the data and returns number of file bytes written. selected holds
+// indices of the manifest entries the receiver picked, when sending several
+// files.
+type streamer func(w io.Writer, selected []int) (int64, error)
+
+// Does the actual sending
+func send(ctx context.Context, relayAddr string, meta Meta, opts Options, open opener) (Result, error) {
+	result := Result{Meta: meta}
+
+	// The relay only gets to see the channel part of the share code,
+	// the secret part is used for key exchange with the receiver.
+	// If no code was given, relay allocates a channel and we pick the secret,
+	// a long random one for uploads since they can be attacked offline.
+	var channel, secret string
+	if opts.ShareCode != "" && opts.Async {
+		return result, errors.New("can't upload to the relay with a custom share code, its secret must be picked at random")
+	}
+	if opts.ShareCode != "" {
+		var err error
+		channel, secret, err = proto.SplitShareCode(proto.NormalizeShareCode(opts.ShareCode))
+		if err != nil {
+			return result, err
+		}
+	} else if opts.Async {
+		var err error
+		secret, err = storedSecret()
+		if err != nil {
+			return result, fmt.Errorf("generating share code: %w", err)
+		}
+	} else if opts.CodeWords > 0 {
+		var err error
+		secret, err = wordcode.Generate(opts.CodeWords)
+		if err != nil {
+			return result, fmt.Errorf("generating share code: %w", err)
+		}
+	} else {
+		var err error
+		secret, err = utils.RandCode()
+		if err != nil {
+			return result, fmt.Errorf("generating share code: %w", err)
+		}
+	}
+
+	opts.limiter = ratelimit.New(opts.RateLimit)
+	if opts.Compress != "" && opts.Compress != proto.CapGzip {
+		return result, fmt.Errorf("unknown compression %q, only %s is supported", opts.Compress, proto.CapGzip)
+	}
+	if opts.Async {
+		if opts.LAN || fanningOut(opts) {
+			return result, errors.New("can't upload to the relay when sending on the local network or to several receivers")
+		}
+		return store(ctx, relayAddr, channel, secret, result, opts, open)
+	}
+	if fanningOut(opts) {
+		if opts.LAN {
+			return result, errors.New("can't send to several receivers on the local network")
+		}
+		return fanOut(ctx, relayAddr, channel, secret, meta, opts, open)
+	}
+
+	for {
+		attempt, err := sendOnce(ctx, relayAddr, channel, secret, result, opts, open)
+		channel, _, _ = proto.SplitShareCode(attempt.ShareCode)
+		if opts.LAN && errors.Is(err, secure.ErrKeyMismatch) && ctx.Err() == nil {
+			// Anyone on the network can connect to us, keep announcing
+			// until the receiver with our share code shows up
+			opts.logf("Receiver had a different share code, waiting for another\n")
+			continue
+		}
+		if !errors.Is(err, ErrDeclined) || !opts.WaitAfterDecline || ctx.Err() != nil {
+			return attempt, err
+		}
+		if opts.OnDeclined != nil {
+			opts.OnDeclined()
+		}
+		// Nothing was read yet, so the same data can be offered again
+		// under the share code the receiver already knows
+	}
+}
+
+// Gets paired with a receiver, who either shows up at the relay
+// or connects with us directly on the local network, and sends to them
+func sendOnce(ctx context.Context, relayAddr string, channel, secret string, result Result, opts Options, open opener) (Result, error) {
+	var conn *relayConn
+	var peerCaps []string
+	var err error
+	if opts.LAN {
+		conn, peerCaps, result.ShareCode, err = pairOnLAN(ctx, channel, secret, opts)
+		result.Direct = true
+	} else {
+		conn, peerCaps, result.ShareCode, err = pairViaRelay(ctx, relayAddr, channel, secret, result.Meta, opts)
+	}
+	if err != nil {
+		return result, ctxErr(ctx, err)
+	}
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+	src, stream := open()
+	return transfer(ctx, conn, peerCaps, result, opts, src, stream)
+}
+
+// Sends the file to a receiver we've been paired with on conn
+func transfer(ctx context.Context, conn *relayConn, peerCaps []string, result Result, opts Options, src io.Reader, stream streamer) (Result, error) {
+	meta := result.Meta
+	if meta.IsDir && !slices.Contains(peerCaps, proto.CapFolders) {
+		return result, fmt.Errorf("receiving folders: %w", ErrUnsupported)
+	}
+	if meta.Manifest != nil && !slices.Contains(peerCaps, proto.CapFiles) {
+		return result, fmt.Errorf("receiving several files: %w", ErrUnsupported)
+	}
+	streamed := meta.Size < 0
+	if streamed && !slices.Contains(peerCaps, proto.CapStream) {
+		return result, fmt.Errorf("receiving data of unknown size: %w", ErrUnsupported)
+	}
+	codec := negotiateCodec(opts.Compress, peerCaps)
+	if codec != opts.Compress {
+		opts.logf("Receiver can't decompress %s, sending uncompressed\n", opts.Compress)
+	}
+
+	// Agree on a key with the receiver, everything after this point
+	// is encrypted and opaque to the relay
+	conn.timeout = opts.IdleTimeout
+	sconn, err := secure.Establish(conn, pake.RoleSender, result.ShareCode)
+	if errors.Is(err, secure.ErrKeyMismatch) && !result.Direct {
+		// Lets the relay ban whoever keeps guessing share codes,
+		// older relays just pass this on to the receiver
+		proto.WriteFrame(conn, proto.OpcodeWrongPeer, nil)
+	}
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("establishing secure channel with receiver: %w", err))
+	}
+
+	// Try to get off the relay, everything from here on goes
+	// through a direct connection with the peer if it works
+	if slices.Contains(peerCaps, proto.CapDirect) {
+		dc, err := connectDirect(ctx, sconn, pake.RoleSender, result.ShareCode, conn.observedAddr, opts)
+		if err != nil {
+			return result, ctxErr(ctx, err)
+		}
+		if dc != nil {
+			conn.Close()
+			conn, sconn = dc.conn, dc.sconn
+			conn.timeout = opts.IdleTimeout
+			defer conn.Close()
+			defer closeOnCancel(ctx, conn)()
+			result.Direct = true
+		}
+	}
+	if !result.Direct {
+		opts.logf("Transferring through relay\n")
+	}
+	_, err = proto.WriteFrame(sconn, proto.OpcodeFileOffer, proto.JSONToBytes(proto.FileOfferPayload{
+		Filesize: meta.Size,
+		Filename: meta.Name,
+		IsDir:    meta.IsDir,
+		Files:    meta.Files,
+		Streamed: streamed,
+		Codec:    codec,
+		Manifest: meta.Manifest,
+	}))
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("sending file details: %w", err))
+	}
+	conn.timeout = opts.WaitTimeout // receiver might be asked to accept the file
+	opcode, payload, err := proto.ReadFrame(sconn)
+	conn.timeout = opts.IdleTimeout
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(err, proto.ErrCancelled) {
+			return result, ErrDeclined // receiver gave up after seeing the offer
+		}
+		// Hanging up says nothing about the offer, the receiver
+		// or the connection with them could have gone away
+		return result, ctxErr(ctx, fmt.Errorf("waiting for receiver to get ready: %w", err))
+	}
+	if opcode == proto.OpcodeDecline {
+		return result, ErrDeclined
+	}
+	if opcode != proto.OpcodeReadyToRecieve {
+		return result, fmt.Errorf("unexpected opcode from receiver, have %s want %s", opcode, proto.OpcodeReadyToRecieve)
+	}
+	ready, err := proto.ParseJSON[proto.ReadyToRecievePayload](payload)
+	if err != nil {
+		return result, fmt.Errorf("malformed ready notification: %w", err)
+	}
+	if meta.Manifest != nil {
+		if err := checkSelection(ready.Selected, len(meta.Manifest)); err != nil {
+			return result, err
+		}
+		// Only the picked files count from here on
+		meta.Size, meta.Files = 0, len(ready.Selected)
+		for _, i := range ready.Selected {
+			meta.Size += meta.Manifest[i].Size
+		}
+		result.Meta = meta
+	}
+
+	// Receiver might already have part of the file from an earlier
+	// attempt, continue from there if it matches our file
+	digest := sha256.New()
+	seeker, canSeek := src.(io.ReadSeeker)
+	if ready.Offset > 0 && canSeek && !streamed && slices.Contains(peerCaps, proto.CapResume) {
+		result.Offset, err = resumeOffset(seeker, meta.Size, ready, digest)
+		if err != nil {
+			return result, fmt.Errorf("reading file: %w", err)
+		}
+		if result.Offset > 0 {
+			opts.logf("Resuming from %s, receiver already has part of the file\n", utils.ReadableSize(result.Offset))
+		} else {
+			opts.logf("Receiver's partial file doesn't match, sending from the start\n")
+		}
+	}
+	_, err = proto.WriteFrame(sconn, proto.OpcodeStreamStart, proto.JSONToBytes(proto.StreamStartPayload{
+		Offset: result.Offset,
+	}))
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("starting stream: %w", err))
+	}
+
+	// Now stream the file, hashing it along the way. Data of unknown size,
+	// or compressed data, goes in chunks so that the receiver can tell
+	// where it ends.
+	peerCancelled := watchCancel(conn)
+	out := newDataWriter(ratelimit.NewWriter(sconn, opts.limiter), codec, streamed)
+	w := newProgressWriter(io.MultiWriter(out, digest), result.Offset, meta.Size, opts.Progress)
+	result.Transferred, err = stream(w, ready.Selected)
+	if err == nil {
+		err = out.Close()
+	}
+	if streamed {
+		result.Meta.Size = result.Transferred
+	}
+	if err != nil {
+		if ctx.Err() == nil && peerCancelled() {
+			err = proto.ErrCancelled
+		}
+		return result, ctxErr(ctx, fmt.Errorf("sending file: %w", err))
+	}
+	if !streamed && result.Offset+result.Transferred != meta.Size {
+		return result, fmt.Errorf("%w, sent (%d/%d) bytes", ErrIncomplete, result.Offset+result.Transferred, meta.Size)
+	}
+
+	// Receiver verifies the data against our hash
+	if slices.Contains(peerCaps, proto.CapDigest) {
+		result.SHA256 = hex.EncodeToString(digest.Sum(nil))
+		_, err = proto.WriteFrame(sconn, proto.OpcodeDigest, proto.JSONToBytes(proto.DigestPayload{
+			SHA256: result.SHA256,
+		}))
+		if err != nil {
+			return result, ctxErr(ctx, fmt.Errorf("sending file hash: %w", err))
+		}
+	}
+	return result, nil
+}
+
+// Makes sure receiver picked some of n manifest entries, each at most once
+// and in order
+func checkSelection(selected []int, n int) error {
+	if len(selected) == 0 {
+		return errors.New("receiver picked no files")
+	}
+	for i, idx := range selected {
+		if idx < 0 || idx >= n || (i > 0 && idx <= selected[i-1]) {
+			return fmt.Errorf("receiver picked invalid files %v", selected)
+		}
+	}
+	return nil
+}
+
+// Registers with the relay, and waits for it to pair us with a receiver.
+// Returns capabilities that relay and receiver both support.
+func pairViaRelay(ctx context.Context, relayAddr string, channel, secret string, meta Meta, opts Options) (conn *relayConn, peerCaps []string, shareCode string, err error) {
+	relay, relayCaps, shareCode, err := register(ctx, relayAddr, channel, secret, meta, opts)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	// Wait for relay's notification that a receiver has been paired with us.
+	// Optional features are only used if relay and receiver both support them
+	peerCaps, err = waitForPeer(ctx, relay, proto.OpcodeCanStartSending, relayCaps, opts.WaitTimeout)
+	if err != nil {
+		relay.Close()
+		return nil, nil, shareCode, fmt.Errorf("waiting for receiver: %w", err)
+	}
+	return relay, peerCaps, shareCode, nil
+}
+
+// Registers with the relay to send meta and gets the share code, all within
+// the handshake timeout. Returns capabilities supported by the relay.
+func register(ctx context.Context, relayAddr string, channel, secret string, meta Meta, opts Options) (conn *relayConn, relayCaps []string, shareCode string, err error) {
+	hctx, cancel := withTimeout(ctx, opts.HandshakeTimeout)
+	defer cancel()
+	relay, relayCaps, err := connect(hctx, relayAddr, opts)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer func() {
+		if err != nil {
+			relay.Close()
+		}
+	}()
+	if fanningOut(opts) && !slices.Contains(relayCaps, proto.CapFanout) {
+		return nil, nil, "", fmt.Errorf("sending to several receivers: %w", ErrRelayTooOld)
+	}
+
+	// Perform send file request
+	_, err = proto.WriteFrameContext(
+		hctx,
+		relay.Conn,
+		proto.OpcodeFileSendRequest,
+		proto.JSONToBytes(proto.FileSendRequestPayload{
+			Channel:   channel,
+			TTL:       int(opts.TTL / time.Second),
+			Receivers: opts.Receivers,
+			Size:      max(meta.Size, 0),
+		}),
+	)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("during send file request: %w", err)
+	}
+	payload, err := proto.ReadExpectedFrameContext(hctx, relay.Conn, proto.OpcodeFileSendResponse)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	fileSendResp, err := proto.ParseJSON[proto.FileSendResponsePayload](payload)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("malformed send file response: %w", err)
+	}
+	shareCode = fileSendResp.Channel + "-" + secret
+	if opts.OnShareCode != nil {
+		opts.OnShareCode(shareCode, time.Duration(fileSendResp.ExpiresIn)*time.Second)
+	}
+	return relay, relayCaps, shareCode, nil
+}
+
+// Checks receiver's partial file against ours and returns the offset to
+// continue sending from, leaving src positioned there. Returns 0 with
+// src rewound if the prefixes differ. The skipped prefix is fed
+// into digest so that it still covers the whole file.
+func resumeOffset(src io.ReadSeeker, size int64, ready proto.ReadyToRecievePayload, digest hash.Hash) (int64, error) {
+	if ready.Offset <= size {
+		prefixHash, err := hashPrefix(digest, src, ready.Offset)
+		if err == nil && bytes.Equal(prefixHash, ready.PrefixHash) {
+			return ready.Offset, nil
+		}
+	}
+	digest.Reset()
+	_, err := src.Seek(0, io.SeekStart)
+	return 0, err
+}
+
+// Feeds the first n bytes read from r into h and returns the hash so far,
+// h can be written to further for hashing the whole file
+func hashPrefix(h hash.Hash, r io.Reader, n int64) ([]byte, error) {
+	if _, err := io.CopyN(h, r, n); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
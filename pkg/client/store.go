@@ -0,0 +1,220 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/diwasrimal/bullet/pkg/pake"
+	"github.com/diwasrimal/bullet/pkg/proto"
+	"github.com/diwasrimal/bullet/pkg/ratelimit"
+	"github.com/diwasrimal/bullet/pkg/secure"
+)
+
+// Length of secrets we pick for share codes of stored uploads, each
+// character adds 5 bits. See secure.StoredKeys.
+const storedSecretLen = 20
+
+// Capabilities stored uploads are read with. There's no receiver to agree
+// with while uploading, so uploads use whatever a receiver of the same
+// version supports. Resuming and declining need someone to talk to.
+var storedCapabilities = []string{
+	proto.CapEncryption,
+	proto.CapFolders,
+	proto.CapDigest,
+	proto.CapStream,
+	proto.CapGzip,
+	proto.CapFiles,
+}
+
+// Picks a random secret long enough for a stored upload, of lowercase
+// letters and digits so that it can be typed in any case
+func storedSecret() (string, error) {
+	buf := make([]byte, storedSecretLen*5/8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)), nil
+}
+
+// Uploads what a receiver would read from us once paired to the relay's
+// storage, encrypted with a key of the upload's own. Nobody answers the
+// offer, so all of it goes in for receivers to pick from later.
+func store(ctx context.Context, relayAddr string, channel, secret string, result Result, opts Options, open opener) (Result, error) {
+	meta := result.Meta
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return result, fmt.Errorf("generating salt: %w", err)
+	}
+	key, access, err := secure.StoredKeys(secret, salt)
+	if err != nil {
+		return result, fmt.Errorf("deriving upload key: %w", err)
+	}
+	accessHash := sha256.Sum256(access)
+
+	hctx, cancel := withTimeout(ctx, opts.HandshakeTimeout)
+	defer cancel()
+	conn, relayCaps, err := connect(hctx, relayAddr, opts)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+	if !slices.Contains(relayCaps, proto.CapStore) {
+		return result, fmt.Errorf("uploading: %w or doesn't keep uploads", ErrRelayTooOld)
+	}
+	_, err = proto.WriteFrameContext(hctx, conn.Conn, proto.OpcodeStoreRequest, proto.JSONToBytes(proto.StoreRequestPayload{
+		Channel:    channel,
+		TTL:        int(opts.TTL / time.Second),
+		Size:       max(meta.Size, 0),
+		Salt:       salt,
+		AccessHash: accessHash[:],
+	}))
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("during store request: %w", err))
+	}
+	payload, err := proto.ReadExpectedFrameContext(hctx, conn.Conn, proto.OpcodeStoreResponse)
+	if err != nil {
+		return result, ctxErr(ctx, err)
+	}
+	storeResp, err := proto.ParseJSON[proto.StoreResponsePayload](payload)
+	if err != nil {
+		return result, fmt.Errorf("malformed store response: %w", err)
+	}
+	result.ShareCode = storeResp.Channel + "-" + secret
+
+	conn.timeout = opts.IdleTimeout
+	sconn, err := secure.NewConn(conn, pake.RoleSender, key)
+	if err != nil {
+		return result, err
+	}
+	streamed := meta.Size < 0
+	_, err = proto.WriteFrame(sconn, proto.OpcodeFileOffer, proto.JSONToBytes(proto.FileOfferPayload{
+		Filesize: meta.Size,
+		Filename: meta.Name,
+		IsDir:    meta.IsDir,
+		Files:    meta.Files,
+		Streamed: streamed,
+		Codec:    opts.Compress,
+		Manifest: meta.Manifest,
+	}))
+	if err == nil {
+		_, err = proto.WriteFrame(sconn, proto.OpcodeStreamStart, proto.JSONToBytes(proto.StreamStartPayload{}))
+	}
+	if err != nil {
+		return result, ctxErr(ctx, cutOffBy(conn, fmt.Errorf("sending file details: %w", err)))
+	}
+
+	selected := make([]int, len(meta.Manifest))
+	for i := range selected {
+		selected[i] = i
+	}
+	_, stream := open()
+	digest := sha256.New()
+	out := newDataWriter(ratelimit.NewWriter(sconn, opts.limiter), opts.Compress, streamed)
+	w := newProgressWriter(io.MultiWriter(out, digest), 0, meta.Size, opts.Progress)
+	result.Transferred, err = stream(w, selected)
+	if err == nil {
+		err = out.Close()
+	}
+	if streamed {
+		result.Meta.Size = result.Transferred
+	}
+	if err != nil {
+		return result, ctxErr(ctx, cutOffBy(conn, fmt.Errorf("uploading file: %w", err)))
+	}
+	if !streamed && result.Transferred != meta.Size {
+		return result, fmt.Errorf("%w, uploaded (%d/%d) bytes", ErrIncomplete, result.Transferred, meta.Size)
+	}
+	result.SHA256 = hex.EncodeToString(digest.Sum(nil))
+	_, err = proto.WriteFrame(sconn, proto.OpcodeDigest, proto.JSONToBytes(proto.DigestPayload{
+		SHA256: result.SHA256,
+	}))
+	if err == nil {
+		// The end is marked in the clear, for the relay
+		_, err = proto.WriteFrame(conn, proto.OpcodeDataEnd, nil)
+	}
+	if err != nil {
+		return result, ctxErr(ctx, cutOffBy(conn, fmt.Errorf("uploading file: %w", err)))
+	}
+
+	// Relay replies once the upload is safely stored
+	payload, err = proto.ReadExpectedFrame(conn, proto.OpcodeStored)
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("waiting for relay to store the upload: %w", err))
+	}
+	stored, err := proto.ParseJSON[proto.StoredPayload](payload)
+	if err != nil {
+		return result, fmt.Errorf("malformed store confirmation: %w", err)
+	}
+	result.Stored = true
+	result.Downloads = stored.Downloads
+	if opts.OnShareCode != nil {
+		opts.OnShareCode(result.ShareCode, time.Duration(stored.ExpiresIn)*time.Second)
+	}
+	return result, nil
+}
+
+// Relay tells why it cut an upload off before hanging up, like running
+// out of room, returns that instead of err if it's there
+func cutOffBy(conn *relayConn, err error) error {
+	conn.Conn.SetReadDeadline(time.Now().Add(time.Second))
+	var relayErr *proto.ErrorPayload
+	if _, readErr := proto.ReadExpectedFrame(conn.Conn, proto.OpcodeStored); errors.As(readErr, &relayErr) {
+		return relayErr
+	}
+	return err
+}
+
+// Gets the upload the relay offered on conn with payload, and receives it
+// as if the sender were streaming it. Once it's all there and verified,
+// the relay is told to count the download.
+func fetch(ctx context.Context, conn *relayConn, secret string, payload []byte, result Result, accept func(meta Meta) (io.Writer, error), opts Options) (Result, error) {
+	result.Stored = true
+	offer, err := proto.ParseJSON[proto.StoredFilePayload](payload)
+	if err != nil {
+		return result, fmt.Errorf("malformed stored upload details: %w", err)
+	}
+	key, access, err := secure.StoredKeys(secret, offer.Salt)
+	if err != nil {
+		return result, fmt.Errorf("deriving upload key: %w", err)
+	}
+	conn.timeout = opts.IdleTimeout
+	_, err = proto.WriteFrame(conn, proto.OpcodeFetchRequest, proto.JSONToBytes(proto.FetchRequestPayload{
+		Access: access,
+	}))
+	if err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("asking for stored upload: %w", err))
+	}
+	sconn, err := secure.NewConn(conn, pake.RoleReceiver, key)
+	if err != nil {
+		return result, err
+	}
+	opts.logf("Receiving upload stored with relay\n")
+	result, err = receive(ctx, playback{sconn}, result, storedCapabilities, accept, opts)
+	if err != nil {
+		return result, err
+	}
+	if _, err := proto.WriteFrame(conn, proto.OpcodeFetchDone, nil); err != nil {
+		return result, ctxErr(ctx, fmt.Errorf("confirming download: %w", err))
+	}
+	return result, nil
+}
+
+// Stored upload read back by the relay. There's no sender on the other
+// end, so what we'd tell them is dropped.
+type playback struct {
+	io.Reader
+}
+
+func (playback) Write(p []byte) (int, error) {
+	return len(p), nil
+}
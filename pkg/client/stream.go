@@ -0,0 +1,142 @@
+package client
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/diwasrimal/bullet/pkg/proto"
+)
+
+// Writes data of unknown size as chunk frames, Close marks the end of it
+// so that the receiver can tell it apart from a transfer cut short
+type chunkWriter struct {
+	w io.Writer
+}
+
+func (cw chunkWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p[:min(len(p), proto.MaxPayloadSize)]
+		if _, err := proto.WriteFrame(cw.w, proto.OpcodeDataChunk, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (cw chunkWriter) Close() error {
+	_, err := proto.WriteFrame(cw.w, proto.OpcodeDataEnd, nil)
+	return err
+}
+
+// Reads data written by a chunkWriter, returning io.EOF only once the end
+// is marked. If r ends before that, io.ErrUnexpectedEOF is returned.
+type chunkReader struct {
+	r       io.Reader
+	pending []byte
+	done    bool
+}
+
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	for len(cr.pending) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		opcode, payload, err := proto.ReadFrame(cr.r)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		switch opcode {
+		case proto.OpcodeDataChunk:
+			cr.pending = payload
+		case proto.OpcodeDataEnd:
+			cr.done = true
+		default:
+			return 0, fmt.Errorf("unexpected opcode in data, have %s want %s", opcode, proto.OpcodeDataChunk)
+		}
+	}
+	n = copy(p, cr.pending)
+	cr.pending = cr.pending[n:]
+	return n, nil
+}
+
+// Returns codec if the receiver can decompress it, no compression otherwise
+func negotiateCodec(codec string, peerCaps []string) string {
+	if codec != "" && !slices.Contains(peerCaps, codec) {
+		return ""
+	}
+	return codec
+}
+
+// Writer of data for the receiver, chunked and compressed as needed.
+// Close flushes it and marks the end.
+type dataWriter struct {
+	io.Writer
+	closers []func() error
+}
+
+func newDataWriter(w io.Writer, codec string, streamed bool) dataWriter {
+	if codec == "" && !streamed {
+		return dataWriter{Writer: w}
+	}
+	cw := chunkWriter{w}
+	if codec == proto.CapGzip {
+		zw := gzip.NewWriter(cw)
+		return dataWriter{Writer: zw, closers: []func() error{zw.Close, cw.Close}}
+	}
+	return dataWriter{Writer: cw, closers: []func() error{cw.Close}}
+}
+
+func (dw dataWriter) Close() error {
+	for _, close := range dw.closers {
+		if err := close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reader of data from the sender, undoing a dataWriter. Close makes sure
+// the data ended where the sender marked its end.
+type dataReader struct {
+	io.Reader
+	chunked bool
+}
+
+func newDataReader(r io.Reader, codec string, streamed bool) (dataReader, error) {
+	switch codec {
+	case "":
+		if !streamed {
+			return dataReader{Reader: r}, nil
+		}
+		return dataReader{Reader: &chunkReader{r: r}, chunked: true}, nil
+	case proto.CapGzip:
+		zr, err := gzip.NewReader(&chunkReader{r: r})
+		if err != nil {
+			return dataReader{}, fmt.Errorf("reading compressed data: %w", err)
+		}
+		return dataReader{Reader: zr, chunked: true}, nil
+	default:
+		return dataReader{}, fmt.Errorf("%q compression: %w", codec, ErrUnsupported)
+	}
+}
+
+func (dr dataReader) Close() error {
+	if !dr.chunked {
+		return nil
+	}
+	extra, err := io.Copy(io.Discard, dr.Reader)
+	if err != nil {
+		return err
+	}
+	if extra > 0 {
+		return fmt.Errorf("sender sent %d bytes more than expected", extra)
+	}
+	return nil
+}
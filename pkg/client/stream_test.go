@@ -0,0 +1,188 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/diwasrimal/bullet/pkg/proto"
+)
+
+func randomData(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, proto.MaxPayloadSize, proto.MaxPayloadSize + 1, 3*proto.MaxPayloadSize + 100} {
+		data := randomData(t, size)
+		var buf bytes.Buffer
+		cw := chunkWriter{&buf}
+		if n, err := cw.Write(data); err != nil || n != size {
+			t.Fatalf("size %d: Write() = %d, %v", size, n, err)
+		}
+		if err := cw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(&chunkReader{r: &buf})
+		if err != nil {
+			t.Errorf("size %d: reading chunks: %v", size, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("size %d: read %d bytes that differ from what was written", size, len(got))
+		}
+	}
+}
+
+func TestChunkedCutShort(t *testing.T) {
+	data := randomData(t, 2*proto.MaxPayloadSize)
+	for name, c := range map[string]struct {
+		frames func(w io.Writer)
+		want   error
+	}{
+		"no data": {
+			frames: func(w io.Writer) {},
+			want:   io.ErrUnexpectedEOF,
+		},
+		"no end": {
+			frames: func(w io.Writer) {
+				chunkWriter{w}.Write(data)
+			},
+			want: io.ErrUnexpectedEOF,
+		},
+		"cut chunk": {
+			frames: func(w io.Writer) {
+				var buf bytes.Buffer
+				chunkWriter{&buf}.Write(data)
+				w.Write(buf.Bytes()[:buf.Len()-10])
+			},
+			want: io.ErrUnexpectedEOF,
+		},
+		"unexpected frame": {
+			frames: func(w io.Writer) {
+				chunkWriter{w}.Write(data[:10])
+				proto.WriteFrame(w, proto.OpcodeStreamStart, nil)
+			},
+		},
+	} {
+		var buf bytes.Buffer
+		c.frames(&buf)
+		_, err := io.ReadAll(&chunkReader{r: &buf})
+		switch {
+		case err == nil:
+			t.Errorf("%s: data was read without an error", name)
+		case c.want != nil && !errors.Is(err, c.want):
+			t.Errorf("%s: have %v, want %v", name, err, c.want)
+		}
+	}
+}
+
+func TestChunkedEndIsFinal(t *testing.T) {
+	var buf bytes.Buffer
+	cw := chunkWriter{&buf}
+	cw.Write([]byte("data"))
+	cw.Close()
+	cw.Write([]byte("more"))
+	cr := &chunkReader{r: &buf}
+	got, err := io.ReadAll(cr)
+	if err != nil || string(got) != "data" {
+		t.Fatalf("ReadAll() = %q, %v, want %q", got, err, "data")
+	}
+	if n, err := cr.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("Read() after the end = %d, %v, want io.EOF", n, err)
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	for _, c := range []struct {
+		codec     string
+		peerCaps  []string
+		wantCodec string
+	}{
+		{"", nil, ""},
+		{"", []string{proto.CapGzip}, ""},
+		{proto.CapGzip, []string{proto.CapStream, proto.CapGzip}, proto.CapGzip},
+		{proto.CapGzip, []string{proto.CapStream}, ""},
+		{proto.CapGzip, nil, ""},
+	} {
+		if got := negotiateCodec(c.codec, c.peerCaps); got != c.wantCodec {
+			t.Errorf("negotiateCodec(%q, %q) = %q, want %q", c.codec, c.peerCaps, got, c.wantCodec)
+		}
+	}
+}
+
+func TestDataRoundTrip(t *testing.T) {
+	data := append(randomData(t, proto.MaxPayloadSize), bytes.Repeat([]byte("compressible "), 50000)...)
+	for _, c := range []struct {
+		codec    string
+		streamed bool
+	}{
+		{"", false},
+		{"", true},
+		{proto.CapGzip, false},
+		{proto.CapGzip, true},
+	} {
+		var buf bytes.Buffer
+		w := newDataWriter(&buf, c.codec, c.streamed)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if c.codec == proto.CapGzip && buf.Len() >= len(data) {
+			t.Errorf("codec %q: %d bytes written for %d bytes of data", c.codec, buf.Len(), len(data))
+		}
+
+		r, err := newDataReader(&buf, c.codec, c.streamed)
+		if err != nil {
+			t.Fatalf("codec %q, streamed %v: %v", c.codec, c.streamed, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("codec %q, streamed %v: reading data: %v", c.codec, c.streamed, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("codec %q, streamed %v: read data differs from what was written", c.codec, c.streamed)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("codec %q, streamed %v: Close() = %v", c.codec, c.streamed, err)
+		}
+	}
+}
+
+func TestDataReaderRejects(t *testing.T) {
+	if _, err := newDataReader(&bytes.Buffer{}, "zstd", false); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("unknown codec: have %v, want %v", err, ErrUnsupported)
+	}
+
+	// Data that isn't gzip
+	var buf bytes.Buffer
+	cw := chunkWriter{&buf}
+	cw.Write([]byte("not compressed at all"))
+	cw.Close()
+	if _, err := newDataReader(&buf, proto.CapGzip, false); err == nil {
+		t.Error("data that isn't gzip was accepted")
+	}
+
+	// Data after the end of the gzip stream, but before the end mark
+	var zbuf, end bytes.Buffer
+	w := newDataWriter(&zbuf, proto.CapGzip, false)
+	w.Write([]byte("data"))
+	w.Close()
+	chunkWriter{&end}.Close()
+	trailing := bytes.NewBuffer(zbuf.Bytes()[:zbuf.Len()-end.Len()])
+	chunkWriter{trailing}.Write([]byte("extra"))
+	chunkWriter{trailing}.Close()
+	r, err := newDataReader(trailing, proto.CapGzip, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil && r.Close() == nil {
+		t.Error("data after the end of the gzip stream was accepted")
+	}
+}
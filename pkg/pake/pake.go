@@ -0,0 +1,210 @@
+// Package pake implements SPAKE2 over the 2048-bit MODP group from RFC 3526.
+//
+// Sender and receiver both know the (low entropy) share code. Each side
+// sends a single message, after which both derive the same key only if
+// they used the same code. Someone in the middle, like the relay, gets one
+// guess at the code per session and learns nothing from observing it.
+package pake
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+type Role byte
+
+const (
+	RoleSender Role = iota
+	RoleReceiver
+)
+
+// Size of a PAKE message in bytes
+const MessageSize = 256
+
+var ErrInvalidMessage = errors.New("invalid PAKE message")
+
+var (
+	// RFC 3526 group 14 prime, 2 generates the subgroup of order (p-1)/2
+	p = mustParseHex(`
+		FFFFFFFF FFFFFFFF C90FDAA2 2168C234 C4C6628B 80DC1CD1
+		29024E08 8A67CC74 020BBEA6 3B139B22 514A0879 8E3404DD
+		EF9519B3 CD3A431B 302B0A6D F25F1437 4FE1356D 6D51C245
+		E485B576 625E7EC6 F44C42E9 A637ED6B 0BFF5CB6 F406B7ED
+		EE386BFB 5A899FA5 AE9F2411 7C4B1FE6 49286651 ECE45B3D
+		C2007CB8 A163BF05 98DA4836 1C55D39A 69163FA8 FD24CF5F
+		83655D23 DCA3AD96 1C62F356 208552BB 9ED52907 7096966D
+		670C354E 4ABC9804 F1746C08 CA18217C 32905E46 2E36CE3B
+		E39E772C 180E8603 9B2783A2 EC07A28F B5C55DF0 6F4C52C9
+		DE2BCBF6 95581718 3995497C EA956AE5 15D22618 98FA0510
+		15728E5A 8AACAA68 FFFFFFFF FFFFFFFF`)
+	q = new(big.Int).Rsh(p, 1)
+	g = big.NewInt(2)
+
+	// Blinding elements for sender and receiver, nobody knows their
+	// discrete log since they're derived by hashing
+	m = hashToGroup("bullet spake2 M")
+	n = hashToGroup("bullet spake2 N")
+)
+
+// Session holds one side's state of a single key exchange.
+// A session must not be reused after [Session.Finish].
+type Session struct {
+	role Role
+	w    *big.Int // password scalar
+	x    *big.Int // our secret exponent
+	msg  []byte   // our outgoing message
+	key  []byte   // shared key, set after Finish
+}
+
+// New starts a key exchange for the given role using password as the
+// shared secret.
+func New(role Role, password string) (*Session, error) {
+	x, err := rand.Int(rand.Reader, new(big.Int).Sub(q, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	x.Add(x, big.NewInt(1)) // x in [1, q)
+
+	s := &Session{
+		role: role,
+		w:    passwordScalar(password),
+		x:    x,
+	}
+
+	// Sender sends g^x * M^w, receiver sends g^x * N^w
+	blind := s.ownBlind()
+	elem := new(big.Int).Exp(g, x, p)
+	elem.Mul(elem, new(big.Int).Exp(blind, s.w, p))
+	elem.Mod(elem, p)
+	s.msg = elem.FillBytes(make([]byte, MessageSize))
+	return s, nil
+}
+
+// Message returns the message that must be delivered to the peer.
+func (s *Session) Message() []byte {
+	return s.msg
+}
+
+// Finish consumes peer's message and computes the shared key.
+// The key only matches peer's if both used the same password, which
+// should be checked with [Session.Confirmation] before using the key.
+func (s *Session) Finish(peerMsg []byte) error {
+	if len(peerMsg) != MessageSize {
+		return ErrInvalidMessage
+	}
+	y := new(big.Int).SetBytes(peerMsg)
+
+	// Make sure the element lies in the prime order subgroup
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(p, big.NewInt(1))) >= 0 {
+		return ErrInvalidMessage
+	}
+	if new(big.Int).Exp(y, q, p).Cmp(big.NewInt(1)) != 0 {
+		return ErrInvalidMessage
+	}
+
+	// Remove peer's blinding: z = (y / peerBlind^w)^x
+	unblind := new(big.Int).Exp(s.peerBlind(), s.w, p)
+	unblind.ModInverse(unblind, p)
+	z := new(big.Int).Mul(y, unblind)
+	z.Mod(z, p)
+	z.Exp(z, s.x, p)
+
+	// Transcript is always ordered sender first
+	senderMsg, receiverMsg := s.msg, peerMsg
+	if s.role == RoleReceiver {
+		senderMsg, receiverMsg = peerMsg, s.msg
+	}
+	h := sha256.New()
+	for _, part := range [][]byte{
+		[]byte("bullet spake2"),
+		senderMsg,
+		receiverMsg,
+		z.FillBytes(make([]byte, MessageSize)),
+		s.w.Bytes(),
+	} {
+		binary.Write(h, binary.BigEndian, uint64(len(part)))
+		h.Write(part)
+	}
+	s.key = h.Sum(nil)
+	return nil
+}
+
+// Confirmation returns a tag proving to peer that we derived the same key.
+func (s *Session) Confirmation() []byte {
+	return s.confirmationFor(s.role)
+}
+
+// VerifyConfirmation reports whether peer derived the same key as us.
+func (s *Session) VerifyConfirmation(tag []byte) bool {
+	peer := RoleReceiver
+	if s.role == RoleReceiver {
+		peer = RoleSender
+	}
+	return hmac.Equal(tag, s.confirmationFor(peer))
+}
+
+// Key returns the session key, it should only be used once confirmation
+// from peer has been verified.
+func (s *Session) Key() []byte {
+	return derive(s.key, "session")
+}
+
+func (s *Session) confirmationFor(role Role) []byte {
+	label := "sender"
+	if role == RoleReceiver {
+		label = "receiver"
+	}
+	return derive(derive(s.key, "confirm"), label)
+}
+
+func (s *Session) ownBlind() *big.Int {
+	if s.role == RoleSender {
+		return m
+	}
+	return n
+}
+
+func (s *Session) peerBlind() *big.Int {
+	if s.role == RoleSender {
+		return n
+	}
+	return m
+}
+
+func derive(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func passwordScalar(password string) *big.Int {
+	sum := sha256.Sum256([]byte("bullet spake2 password:" + password))
+	w := new(big.Int).SetBytes(sum[:])
+	return w.Mod(w, q)
+}
+
+// Hashes label to an element of the prime order subgroup by squaring
+// a hash output that is wider than p.
+func hashToGroup(label string) *big.Int {
+	var wide []byte
+	for i := byte(0); len(wide) < MessageSize+32; i++ {
+		sum := sha256.Sum256(append([]byte(label), i))
+		wide = append(wide, sum[:]...)
+	}
+	e := new(big.Int).SetBytes(wide)
+	e.Mod(e, p)
+	return e.Exp(e, big.NewInt(2), p)
+}
+
+func mustParseHex(s string) *big.Int {
+	v, ok := new(big.Int).SetString(strings.Join(strings.Fields(s), ""), 16)
+	if !ok {
+		panic("pake: invalid hex constant")
+	}
+	return v
+}
@@ -0,0 +1,71 @@
+package pake
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Runs the exchange between a sender using senderCode and a receiver
+// using receiverCode
+func exchange(t *testing.T, senderCode, receiverCode string) (sender, receiver *Session) {
+	t.Helper()
+	sender, err := New(RoleSender, senderCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err = New(RoleReceiver, receiverCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.Finish(receiver.Message()); err != nil {
+		t.Fatalf("sender finishing: %v", err)
+	}
+	if err := receiver.Finish(sender.Message()); err != nil {
+		t.Fatalf("receiver finishing: %v", err)
+	}
+	return sender, receiver
+}
+
+func TestRoundTrip(t *testing.T) {
+	sender, receiver := exchange(t, "20-crystal-pigeon-harbor", "20-crystal-pigeon-harbor")
+	if !sender.VerifyConfirmation(receiver.Confirmation()) {
+		t.Error("sender rejected receiver's confirmation")
+	}
+	if !receiver.VerifyConfirmation(sender.Confirmation()) {
+		t.Error("receiver rejected sender's confirmation")
+	}
+	if !bytes.Equal(sender.Key(), receiver.Key()) {
+		t.Error("sender and receiver derived different keys")
+	}
+}
+
+func TestWrongCode(t *testing.T) {
+	sender, receiver := exchange(t, "20-crystal-pigeon-harbor", "20-crystal-pigeon-harbour")
+	if sender.VerifyConfirmation(receiver.Confirmation()) {
+		t.Error("sender accepted confirmation of a different code")
+	}
+	if receiver.VerifyConfirmation(sender.Confirmation()) {
+		t.Error("receiver accepted confirmation of a different code")
+	}
+	if bytes.Equal(sender.Key(), receiver.Key()) {
+		t.Error("different codes derived the same key")
+	}
+}
+
+func TestInvalidMessage(t *testing.T) {
+	s, err := New(RoleSender, "20-crystal-pigeon-harbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := make([]byte, MessageSize)
+	one[MessageSize-1] = 1
+	for name, msg := range map[string][]byte{
+		"short":    make([]byte, MessageSize-1),
+		"zero":     make([]byte, MessageSize),
+		"identity": one,
+	} {
+		if err := s.Finish(msg); err != ErrInvalidMessage {
+			t.Errorf("%s message: have %v, want %v", name, err, ErrInvalidMessage)
+		}
+	}
+}
@@ -2,18 +2,66 @@ package proto
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/diwasrimal/bullet/pkg/utils"
 )
 
 type Opcode byte
 
+// Protocol version spoken by this package. Version 1 was the original
+// unencrypted protocol with an empty handshake, version 2 added end-to-end
+// encryption and capability negotiation.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 2 // oldest version we can still talk to
+)
+
+// Capabilities are optional features negotiated during the handshake.
+// Client sends what it supports, relay replies with the ones it supports
+// as well, and when pairing tells each peer about the other's capabilities.
+const (
+	CapEncryption = "encryption"
+	CapFolders    = "folders"
+	CapResume     = "resume"
+	CapDigest     = "digest"
+	CapDirect     = "direct"
+	CapFanout     = "fanout"  // relay can pair several receivers with one sender
+	CapStream     = "stream"  // data of unknown size, like from a pipe, can be received
+	CapGzip       = "gzip"    // data can be gzip compressed, also the codec's name in FileOfferPayload
+	CapFiles      = "files"   // several files can be offered together, receiver picks which ones to get
+	CapDecline    = "decline" // receiver tells sender when it turns down the offer, instead of hanging up
+	CapStore      = "store"   // relay keeps uploads for receivers that show up later, see OpcodeStoreRequest
+)
+
+// All capabilities implemented by this package
+var Capabilities = []string{
+	CapEncryption,
+	CapFolders,
+	CapResume,
+	CapDigest,
+	CapDirect,
+	CapFanout,
+	CapStream,
+	CapGzip,
+	CapFiles,
+	CapDecline,
+	CapStore,
+}
+
+// Opcodes are only ever added at the end, so that clients and relays of
+// any version agree on the ones they both know about. Numbers of existing
+// opcodes must never change, TestOpcodeValues pins them.
 const (
 	// Handshake codes, used for establishing client-server connection
 	OpcodeHandshakeRequest Opcode = iota + 48 // can use netcat :)
@@ -27,13 +75,64 @@ const (
 	OpcodeTextMsg
 
 	// Notification codes
-	OpcodeShareCodeNotAvailable
-	OpcodeShareCodeNotFound
-	OpcodeReadyToRecieve  // reciver sends to notify they are ready to accept file
-	OpcodeCanStartSending // server notifies sender that they can start sending their file
+	OpcodeShareCodeNotAvailable // deprecated, relay sends OpcodeError instead
+	OpcodeShareCodeNotFound     // deprecated, relay sends OpcodeError instead
+	OpcodeReadyToRecieve        // reciver sends to notify they are ready to accept file
+	OpcodeCanStartSending       // server notifies sender that they can start sending their file
 	// OpcodeCanStartRecving
 
 	OpcodeInvalid
+
+	// Handshake failures, clients of any version must be able to tell these
+	OpcodeVersionMismatch // server can't talk client's protocol version
+	OpcodeError           // something went wrong, details are in an ErrorPayload
+
+	// End-to-end codes, exchanged between sender and receiver through the
+	// relay after they have been paired. The relay only pipes them.
+	OpcodeKeyExchange    // PAKE message derived from the share code
+	OpcodeKeyConfirm     // proof that both peers derived the same key
+	OpcodeEncryptedChunk // a sealed chunk of the encrypted stream
+	OpcodeFileOffer      // sender tells receiver about the file, sent encrypted
+	OpcodeArchiveEntry   // header of an entry in a folder being sent, file data follows
+	OpcodeArchiveEnd     // no more entries in the folder
+	OpcodeStreamStart    // sender tells receiver the offset from which data follows
+	OpcodeDigest         // trailing hash of everything streamed, sent after the data
+	OpcodeCancel         // peer gave up on the transfer, sent unencrypted so it can interrupt anything
+	OpcodeCandidates     // addresses a peer can be reached at directly, sent encrypted
+	OpcodeDirectHello    // first frame on a direct connection between peers, identifies it
+	OpcodeDirectChosen   // receiver tells which direct connection to use, if any, sent encrypted
+
+	// Sent over UDP multicast by senders on the local network, when not using a relay
+	OpcodeLANAnnounce
+
+	// Fan-out codes, for senders serving several receivers with one share code
+	OpcodeReceiverJoined // relay tells sender a receiver is waiting, on the connection it registered with
+	OpcodeServeReceiver  // sender connects again to serve that receiver, relay pairs them
+
+	// End-to-end codes for data of unknown size, sent encrypted
+	OpcodeDataChunk // a piece of the data
+	OpcodeDataEnd   // no more data follows
+
+	// Sent by a sender in place of its first encrypted frame, with no
+	// payload, when the receiver it was paired with had a different share
+	// code. Relays count it against the receiver like a failed lookup.
+	// Fan-out senders also send it with WrongPeerPayload on the connection
+	// they registered with, and relays may invalidate the share code
+	// after too many of these.
+	OpcodeWrongPeer
+
+	// Receiver turns down the file offer, sent encrypted in place of
+	// OpcodeReadyToRecieve
+	OpcodeDecline
+
+	// Store-and-forward codes, for senders uploading to the relay's storage
+	// instead of waiting for a receiver to show up
+	OpcodeStoreRequest  // sender asks to upload, instead of a send request
+	OpcodeStoreResponse // relay allocated the channel, sender streams the upload followed by OpcodeDataEnd
+	OpcodeStored        // relay has the whole upload, sent to the sender
+	OpcodeStoredFile    // relay tells a receiver the channel holds an upload, instead of pairing
+	OpcodeFetchRequest  // receiver proves it knows the share code, relay then streams the upload
+	OpcodeFetchDone     // receiver got and verified the upload, relay counts it as a download
 )
 
 func (c Opcode) String() string {
@@ -60,35 +159,391 @@ func (c Opcode) String() string {
 		return "OpcodeReadyToRecieve"
 	case OpcodeCanStartSending:
 		return "OpcodeCanStartSending"
+	case OpcodeVersionMismatch:
+		return "OpcodeVersionMismatch"
+	case OpcodeError:
+		return "OpcodeError"
+	case OpcodeKeyExchange:
+		return "OpcodeKeyExchange"
+	case OpcodeKeyConfirm:
+		return "OpcodeKeyConfirm"
+	case OpcodeEncryptedChunk:
+		return "OpcodeEncryptedChunk"
+	case OpcodeFileOffer:
+		return "OpcodeFileOffer"
+	case OpcodeArchiveEntry:
+		return "OpcodeArchiveEntry"
+	case OpcodeArchiveEnd:
+		return "OpcodeArchiveEnd"
+	case OpcodeStreamStart:
+		return "OpcodeStreamStart"
+	case OpcodeDigest:
+		return "OpcodeDigest"
+	case OpcodeCancel:
+		return "OpcodeCancel"
+	case OpcodeCandidates:
+		return "OpcodeCandidates"
+	case OpcodeDirectHello:
+		return "OpcodeDirectHello"
+	case OpcodeDirectChosen:
+		return "OpcodeDirectChosen"
+	case OpcodeLANAnnounce:
+		return "OpcodeLANAnnounce"
+	case OpcodeReceiverJoined:
+		return "OpcodeReceiverJoined"
+	case OpcodeServeReceiver:
+		return "OpcodeServeReceiver"
+	case OpcodeDataChunk:
+		return "OpcodeDataChunk"
+	case OpcodeDataEnd:
+		return "OpcodeDataEnd"
+	case OpcodeWrongPeer:
+		return "OpcodeWrongPeer"
+	case OpcodeDecline:
+		return "OpcodeDecline"
+	case OpcodeStoreRequest:
+		return "OpcodeStoreRequest"
+	case OpcodeStoreResponse:
+		return "OpcodeStoreResponse"
+	case OpcodeStored:
+		return "OpcodeStored"
+	case OpcodeStoredFile:
+		return "OpcodeStoredFile"
+	case OpcodeFetchRequest:
+		return "OpcodeFetchRequest"
+	case OpcodeFetchDone:
+		return "OpcodeFetchDone"
 	default:
 		return "OpcodeInvalid"
 	}
 }
 
 type Payload interface {
-	FileSendRequestPayload |
+	HandshakeRequestPayload |
+		HandshakeResponsePayload |
+		PairedPayload |
+		ErrorPayload |
+		FileSendRequestPayload |
 		FileSendResponsePayload |
 		FileRecvRequestPayload |
-		FileRecvResponsePayload
+		FileOfferPayload |
+		ArchiveEntryPayload |
+		ReadyToRecievePayload |
+		StreamStartPayload |
+		DigestPayload |
+		CandidatesPayload |
+		DirectHelloPayload |
+		DirectChosenPayload |
+		LANAnnouncePayload |
+		ReceiverJoinedPayload |
+		ServeReceiverPayload |
+		WrongPeerPayload |
+		StoreRequestPayload |
+		StoreResponsePayload |
+		StoredPayload |
+		StoredFilePayload |
+		FetchRequestPayload
+}
+
+// Clients of protocol version 1 send an empty handshake payload
+type HandshakeRequestPayload struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	Token        string   `json:"token,omitempty"` // API token, for relays that restrict access
+}
+
+// Sent by the relay with both OpcodeHandshakeResponse and
+// OpcodeVersionMismatch. Version is the negotiated version,
+// Capabilities are the ones supported by both client and relay.
+type HandshakeResponsePayload struct {
+	Version      int      `json:"version"`
+	MinVersion   int      `json:"min_version"`
+	Capabilities []string `json:"capabilities"`
+	ObservedAddr string   `json:"observed_addr,omitempty"` // client's address as seen by the relay
+}
+
+// Sent by the relay with OpcodeFileRecvResponse and OpcodeCanStartSending
+// once sender and receiver are paired, Capabilities being the other peer's.
+// Optional features are only used when both peers support them.
+type PairedPayload struct {
+	Capabilities []string `json:"capabilities"`
+}
+
+// Machine readable reason sent in error frames
+type ErrorCode string
+
+const (
+	ErrShareCodeNotFound     ErrorCode = "share_code_not_found"
+	ErrShareCodeNotAvailable ErrorCode = "share_code_not_available"
+	ErrBadRequest            ErrorCode = "bad_request" // unexpected opcode or malformed payload
+	ErrInternal              ErrorCode = "internal"
+	ErrShareCodeExpired      ErrorCode = "share_code_expired" // no receiver showed up in time
+	ErrShuttingDown          ErrorCode = "shutting_down"
+	ErrUnauthorized          ErrorCode = "unauthorized"           // relay needs an API token, and none or an unknown one was given
+	ErrForbidden             ErrorCode = "forbidden"              // API token doesn't allow the request
+	ErrTooLarge              ErrorCode = "too_large"              // file is over the API token's size limit
+	ErrRateLimited           ErrorCode = "rate_limited"           // too many failed requests, client is banned for a while
+	ErrShareCodeInvalidated  ErrorCode = "share_code_invalidated" // too many receivers had a different share code
+	ErrStoreFull             ErrorCode = "store_full"             // relay's storage for uploads is used up
+	ErrUploadInProgress      ErrorCode = "upload_in_progress"     // share code is right, but the sender is still uploading
+)
+
+// Returned when reading an OpcodeCancel frame from the peer
+var ErrCancelled = errors.New("peer cancelled the transfer")
+
+// Payload of OpcodeError frames. It's also an error itself, so that
+// clients can return it as is and callers can inspect Code with errors.As
+type ErrorPayload struct {
+	Code       ErrorCode `json:"code"`
+	Message    string    `json:"message"`               // human readable
+	RetryAfter int       `json:"retry_after,omitempty"` // seconds, if trying again later might work
+}
+
+func (e *ErrorPayload) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s (retry after %s)", e.Message, time.Duration(e.RetryAfter)*time.Second)
+	}
+	return e.Message
+}
+
+// Sends an error frame with a formatted message
+func WriteError(conn io.Writer, code ErrorCode, format string, a ...any) (n int, err error) {
+	return WriteFrame(conn, OpcodeError, JSONToBytes(ErrorPayload{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}))
+}
+
+// Reads a frame and makes sure it has the wanted opcode. An error frame
+// is returned as *ErrorPayload, a cancel frame as ErrCancelled and any
+// other opcode as a generic error.
+func ReadExpectedFrame(conn io.Reader, want Opcode) (payload []byte, err error) {
+	return expectFrame(want)(ReadFrame(conn))
+}
+
+// ReadExpectedFrameContext is like [ReadExpectedFrame], but gives up
+// once ctx is done, see [ReadFrameContext].
+func ReadExpectedFrameContext(ctx context.Context, conn net.Conn, want Opcode) (payload []byte, err error) {
+	return expectFrame(want)(ReadFrameContext(ctx, conn))
+}
+
+// ReadExpectedFramesContext is like [ReadExpectedFrameContext], but any
+// of wants is expected and the opcode read is returned along with it.
+func ReadExpectedFramesContext(ctx context.Context, conn net.Conn, wants ...Opcode) (opcode Opcode, payload []byte, err error) {
+	opcode, payload, err = ReadFrameContext(ctx, conn)
+	if err == nil && slices.Contains(wants, opcode) {
+		return opcode, payload, nil
+	}
+	payload, err = expectFrame(wants[0])(opcode, payload, err)
+	return opcode, payload, err
 }
 
+func expectFrame(want Opcode) func(opcode Opcode, payload []byte, err error) ([]byte, error) {
+	return func(opcode Opcode, payload []byte, err error) ([]byte, error) {
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case want:
+			return payload, nil
+		case OpcodeError:
+			errPayload, err := ParseJSON[ErrorPayload](payload)
+			if err != nil {
+				return nil, fmt.Errorf("malformed error frame: %w", err)
+			}
+			return nil, &errPayload
+		case OpcodeCancel:
+			return nil, ErrCancelled
+		default:
+			return nil, fmt.Errorf("unexpected opcode, have %s want %s", opcode, want)
+		}
+	}
+}
+
+// Returns capabilities present in both a and b
+func IntersectCapabilities(a, b []string) []string {
+	common := []string{}
+	for _, c := range a {
+		if slices.Contains(b, c) {
+			common = append(common, c)
+		}
+	}
+	return common
+}
+
+// The relay only ever sees the channel part of a share code, the rest of
+// the code is the secret both peers use for the key exchange.
+// Filename and size are sent to the receiver in a [FileOfferPayload]
+// after the secure channel has been established.
 type FileSendRequestPayload struct {
-	ShareCode string `json:"share_code"` // Custom file share code requested by sender
-	Filesize  int64  `json:"filesize"`
-	Filename  string `json:"filename"`
+	Channel string `json:"channel"`       // Custom channel requested by sender, allocated by relay if empty
+	TTL     int    `json:"ttl,omitempty"` // seconds the share code should stay valid, relay's default if 0
+
+	// How many receivers can get the file, 0 meaning one and negative
+	// meaning no limit. Needs CapFanout if not one, receivers are then
+	// announced with OpcodeReceiverJoined instead of pairing right away.
+	Receivers int `json:"receivers,omitempty"`
+
+	// Bytes about to be sent if known, so that relays limiting
+	// file size can refuse right away instead of midway
+	Size int64 `json:"size,omitempty"`
 }
 
 type FileSendResponsePayload struct {
-	ShareCode string `json:"share_code"`
+	Channel   string `json:"channel"`
+	ExpiresIn int    `json:"expires_in,omitempty"` // seconds until the share code expires, 0 if never
 }
 
 type FileRecvRequestPayload struct {
-	ShareCode string `json:"share_code"`
+	Channel string `json:"channel"`
 }
 
-type FileRecvResponsePayload struct {
+// When sending a folder, Filesize is the total size of files in it and
+// the contents follow as a stream of archive entries. When Streamed, the
+// size isn't known upfront and data follows in OpcodeDataChunk frames
+// until an OpcodeDataEnd, which needs CapStream. Compressed data is sent
+// in chunks as well, while Filesize remains the uncompressed size.
+type FileOfferPayload struct {
 	Filesize int64  `json:"filesize"`
 	Filename string `json:"filename"`
+	IsDir    bool   `json:"is_dir,omitempty"`
+	Files    int    `json:"files,omitempty"` // number of files in the folder
+	Streamed bool   `json:"streamed,omitempty"`
+	Codec    string `json:"codec,omitempty"` // compression of the data, like CapGzip, empty if none
+
+	// Files offered together instead of a single one, Filesize and Files
+	// are their totals. Selected ones are streamed like a folder.
+	Manifest []ManifestEntry `json:"manifest,omitempty"`
+}
+
+type ManifestEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Receiver with a partial file asks to resume from Offset, sending hash of
+// the data it already has so that sender can make sure it's the same file
+type ReadyToRecievePayload struct {
+	Offset     int64  `json:"offset,omitempty"`
+	PrefixHash []byte `json:"prefix_hash,omitempty"` // SHA-256 of first Offset bytes
+	Selected   []int  `json:"selected,omitempty"`    // indices of manifest entries to send, in order
+}
+
+// Offset is where sender actually starts streaming from, it's 0 if the
+// receiver's partial file didn't match and must be received from scratch
+type StreamStartPayload struct {
+	Offset int64 `json:"offset"`
+}
+
+// Hash of the whole file, including any part skipped due to resuming.
+// For folders, it's the hash of the whole archive stream.
+type DigestPayload struct {
+	SHA256 string `json:"sha256"` // hex encoded
+}
+
+// Exchanged by peers through the relay so that they can try connecting
+// directly. Only connections presenting Token are accepted, and it's only
+// known to the peer since the payload is encrypted.
+type CandidatesPayload struct {
+	Addrs []string `json:"addrs"` // host:port we listen on, can be empty
+	Token string   `json:"token"`
+}
+
+// Sent by the dialing peer on a direct connection, before running the key
+// exchange again over it
+type DirectHelloPayload struct {
+	Token string `json:"token"` // from the other peer's CandidatesPayload
+	ID    string `json:"id"`    // picked by the dialer, names this connection
+}
+
+// Receiver's pick among established direct connections
+type DirectChosenPayload struct {
+	ID string `json:"id"` // empty to keep using the relay
+}
+
+// Sender on the local network announces that it's waiting for a receiver
+// with this channel, on the TCP port where it plays the relay's part
+type LANAnnouncePayload struct {
+	Channel string `json:"channel"`
+	Port    int    `json:"port"`
+}
+
+// Relay's notice to a fan-out sender that a receiver is waiting, the sender
+// should connect again and serve them with a ServeReceiverPayload
+type ReceiverJoinedPayload struct {
+	ID string `json:"id"` // picked by the relay, names the waiting receiver
+}
+
+// Sent by a fan-out sender on a new connection, relay pairs it with the
+// receiver and replies with OpcodeCanStartSending as usual
+type ServeReceiverPayload struct {
+	Channel string `json:"channel"`
+	ID      string `json:"id"` // from ReceiverJoinedPayload
+}
+
+type WrongPeerPayload struct {
+	ID string `json:"id"` // from ReceiverJoinedPayload
+}
+
+// The upload is the encrypted stream a paired receiver would have read,
+// as OpcodeEncryptedChunk frames, keyed by the share code's secret and
+// Salt since there's no peer to agree on a key with. Receivers prove they
+// know the secret with an access proof hashing to AccessHash to get it.
+type StoreRequestPayload struct {
+	Channel    string `json:"channel"`        // Custom channel requested by sender, allocated by relay if empty
+	TTL        int    `json:"ttl,omitempty"`  // seconds the upload should be kept, relay's longest if 0
+	Size       int64  `json:"size,omitempty"` // bytes of file data if known, the upload is slightly larger
+	Salt       []byte `json:"salt"`
+	AccessHash []byte `json:"access_hash"` // SHA-256 of the access proof
+}
+
+type StoreResponsePayload struct {
+	Channel string `json:"channel"`
+}
+
+type StoredPayload struct {
+	ExpiresIn int `json:"expires_in"` // seconds until the upload is deleted
+	Downloads int `json:"downloads"`  // it's deleted after this many downloads
+}
+
+type StoredFilePayload struct {
+	Salt []byte `json:"salt"` // from StoreRequestPayload
+}
+
+type FetchRequestPayload struct {
+	Access []byte `json:"access"` // proof hashing to the upload's AccessHash
+}
+
+type ArchiveEntryPayload struct {
+	Path    string      `json:"path"` // slash separated, relative to the folder
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size"` // bytes of file data following the entry
+}
+
+// SplitShareCode splits a share code of the form CHANNEL-SECRET into
+// the channel (given to the relay for pairing) and the secret.
+func SplitShareCode(code string) (channel, secret string, err error) {
+	channel, secret, found := strings.Cut(code, "-")
+	if !found || channel == "" || secret == "" {
+		return "", "", fmt.Errorf("invalid share code %q, must be of the form CHANNEL-SECRET", code)
+	}
+	return channel, secret, nil
+}
+
+// NormalizeShareCode makes share codes that differ only in case the same.
+// Channels are matched case-insensitively, and so are secrets made of
+// several words. Other secrets, like random characters, keep their case.
+func NormalizeShareCode(code string) string {
+	code = strings.TrimSpace(code)
+	channel, secret, found := strings.Cut(code, "-")
+	if !found {
+		return code
+	}
+	if strings.Contains(secret, "-") {
+		secret = strings.ToLower(secret)
+	}
+	return strings.ToLower(channel) + "-" + secret
 }
 
 func JSONToBytes[T Payload](data T) []byte {
@@ -110,7 +565,13 @@ func EncodeJSONFrame[T Payload](opcode Opcode, data T) []byte {
 	return frame.Bytes()
 }
 
-func WriteFrame(conn net.Conn, opcode Opcode, payload []byte) (n int, err error) {
+// Largest payload a single frame can carry, since payload length is a uint16
+const MaxPayloadSize = 1<<16 - 1
+
+func WriteFrame(conn io.Writer, opcode Opcode, payload []byte) (n int, err error) {
+	if len(payload) > MaxPayloadSize {
+		return 0, fmt.Errorf("payload too large for a frame (%d bytes)", len(payload))
+	}
 	payloadLen := uint16(len(payload))
 	frame := new(bytes.Buffer)
 	frame.WriteByte(byte(opcode))                              // first byte is opcode
@@ -119,7 +580,7 @@ func WriteFrame(conn net.Conn, opcode Opcode, payload []byte) (n int, err error)
 	return conn.Write(frame.Bytes())
 }
 
-func ReadFrame(conn net.Conn) (opcode Opcode, payload []byte, err error) {
+func ReadFrame(conn io.Reader) (opcode Opcode, payload []byte, err error) {
 	var opcodeBuf [1]byte
 	_, err = io.ReadFull(conn, opcodeBuf[:])
 	if err != nil {
@@ -144,6 +605,62 @@ func ReadFrame(conn net.Conn) (opcode Opcode, payload []byte, err error) {
 	return opcode, payload, nil
 }
 
+// ReadFrameContext is like [ReadFrame], but gives up once ctx is done or
+// its deadline passes, returning ctx's error, or its cause if it has one.
+// This is done through conn's deadlines, which are cleared afterwards. A
+// frame might be partially read when giving up, so conn shouldn't be used
+// for frames after that.
+func ReadFrameContext(ctx context.Context, conn net.Conn) (opcode Opcode, payload []byte, err error) {
+	err = withContext(ctx, conn, func() error {
+		opcode, payload, err = ReadFrame(conn)
+		return err
+	})
+	return opcode, payload, err
+}
+
+// WriteFrameContext is like [WriteFrame], but gives up once ctx is done,
+// see [ReadFrameContext].
+func WriteFrameContext(ctx context.Context, conn net.Conn, opcode Opcode, payload []byte) (n int, err error) {
+	err = withContext(ctx, conn, func() error {
+		n, err = WriteFrame(conn, opcode, payload)
+		return err
+	})
+	return n, err
+}
+
+// Runs fn, interrupting any read or write it does on conn once ctx is done
+func withContext(ctx context.Context, conn net.Conn, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	conn.SetDeadline(deadline) // zero deadline, if none, means no deadline
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0)) // some time in past, fails blocked calls immediately
+	})
+	err := fn()
+	if stop() {
+		conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if hasDeadline && errors.Is(err, os.ErrDeadlineExceeded) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+// Like [DecodeJSON] but returns an error instead of panicking, for
+// payloads that come from untrusted peers
+func ParseJSON[T Payload](bytes []byte) (T, error) {
+	var data T
+	err := json.Unmarshal(bytes, &data)
+	return data, err
+}
+
 func DecodeJSON[T Payload](bytes []byte) T {
 	var data T
 	err := json.Unmarshal(bytes, &data)
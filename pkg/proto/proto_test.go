@@ -0,0 +1,53 @@
+package proto
+
+import "testing"
+
+// Opcodes are on the wire, so their numbers must never change. New ones
+// are added at the end of the list.
+func TestOpcodeValues(t *testing.T) {
+	for opcode, want := range map[Opcode]byte{
+		OpcodeHandshakeRequest:      48,
+		OpcodeHandshakeResponse:     49,
+		OpcodeFileSendRequest:       50,
+		OpcodeFileSendResponse:      51,
+		OpcodeFileRecvRequest:       52,
+		OpcodeFileRecvResponse:      53,
+		OpcodeTextMsg:               54,
+		OpcodeShareCodeNotAvailable: 55,
+		OpcodeShareCodeNotFound:     56,
+		OpcodeReadyToRecieve:        57,
+		OpcodeCanStartSending:       58,
+		OpcodeInvalid:               59,
+		OpcodeVersionMismatch:       60,
+		OpcodeError:                 61,
+		OpcodeKeyExchange:           62,
+		OpcodeKeyConfirm:            63,
+		OpcodeEncryptedChunk:        64,
+		OpcodeFileOffer:             65,
+		OpcodeArchiveEntry:          66,
+		OpcodeArchiveEnd:            67,
+		OpcodeStreamStart:           68,
+		OpcodeDigest:                69,
+		OpcodeCancel:                70,
+		OpcodeCandidates:            71,
+		OpcodeDirectHello:           72,
+		OpcodeDirectChosen:          73,
+		OpcodeLANAnnounce:           74,
+		OpcodeReceiverJoined:        75,
+		OpcodeServeReceiver:         76,
+		OpcodeDataChunk:             77,
+		OpcodeDataEnd:               78,
+		OpcodeWrongPeer:             79,
+		OpcodeDecline:               80,
+		OpcodeStoreRequest:          81,
+		OpcodeStoreResponse:         82,
+		OpcodeStored:                83,
+		OpcodeStoredFile:            84,
+		OpcodeFetchRequest:          85,
+		OpcodeFetchDone:             86,
+	} {
+		if byte(opcode) != want {
+			t.Errorf("%s is %d, want %d", opcode, opcode, want)
+		}
+	}
+}
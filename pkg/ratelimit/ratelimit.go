@@ -0,0 +1,162 @@
+// Package ratelimit throttles readers and writers to a number of bytes per
+// second. A [Limiter] can be shared, so that everything using it together
+// stays under its rate.
+package ratelimit
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diwasrimal/bullet/pkg/utils"
+)
+
+// Limiter hands out bytes at a steady rate, letting through a burst of up
+// to a tenth of a second's worth after being idle. A nil *Limiter doesn't
+// limit anything.
+type Limiter struct {
+	rate  float64 // bytes per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64 // negative when bytes were handed out in advance
+	last   time.Time
+}
+
+// New returns a limiter for rate bytes per second, nil if rate isn't positive.
+func New(rate int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := max(float64(rate)/10, 1)
+	return &Limiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait blocks until n bytes can go through.
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.burst)
+	l.last = now
+	// Take the bytes right away and wait off the debt, so that concurrent
+	// users are served in the order they came
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Chunk size that keeps each wait short
+func (l *Limiter) chunk() int {
+	return int(min(max(l.burst, 512), 32*1024))
+}
+
+type writer struct {
+	w        io.Writer
+	limiters []*Limiter
+}
+
+// NewWriter returns a writer to w that stays under the rate of every
+// non-nil limiter. It's w itself if there are none.
+func NewWriter(w io.Writer, limiters ...*Limiter) io.Writer {
+	limiters = nonNil(limiters)
+	if len(limiters) == 0 {
+		return w
+	}
+	return writer{w, limiters}
+}
+
+func (lw writer) Write(p []byte) (n int, err error) {
+	size := chunkSize(lw.limiters)
+	for len(p) > 0 {
+		chunk := p[:min(len(p), size)]
+		for _, l := range lw.limiters {
+			l.Wait(len(chunk))
+		}
+		m, err := lw.w.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+type reader struct {
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// NewReader returns a reader from r that stays under the rate of every
+// non-nil limiter. It's r itself if there are none.
+func NewReader(r io.Reader, limiters ...*Limiter) io.Reader {
+	limiters = nonNil(limiters)
+	if len(limiters) == 0 {
+		return r
+	}
+	return reader{r, limiters}
+}
+
+func (lr reader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p[:min(len(p), chunkSize(lr.limiters))])
+	for _, l := range lr.limiters {
+		l.Wait(n)
+	}
+	return n, err
+}
+
+func nonNil(limiters []*Limiter) []*Limiter {
+	var ls []*Limiter
+	for _, l := range limiters {
+		if l != nil {
+			ls = append(ls, l)
+		}
+	}
+	return ls
+}
+
+func chunkSize(limiters []*Limiter) int {
+	size := limiters[0].chunk()
+	for _, l := range limiters[1:] {
+		size = min(size, l.chunk())
+	}
+	return size
+}
+
+// Rate is a number of bytes per second, zero meaning no limit. It's a
+// [flag.Value] taking sizes like 20MB/s, 512k or 1.5GiB/s.
+type Rate int64
+
+func (r Rate) String() string {
+	if r <= 0 {
+		return "0"
+	}
+	return utils.ReadableSize(int64(r)) + "/s"
+}
+
+func (r *Rate) Set(s string) error {
+	rate, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = Rate(rate)
+	return nil
+}
+
+// ParseRate parses a rate in bytes per second like 20MB/s, where units
+// are those of [utils.ParseSize] and /s is optional.
+func ParseRate(s string) (int64, error) {
+	rate, err := utils.ParseSize(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q, want something like 20MB/s", s)
+	}
+	return rate, nil
+}
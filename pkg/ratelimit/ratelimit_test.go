@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for s, want := range map[string]int64{
+		"0":         0,
+		"20MB/s":    20000000,
+		"20mb/S":    20000000,
+		"512k":      512000,
+		"1.5GiB/s":  1610612736,
+		" 100kb/s ": 100000,
+	} {
+		got, err := ParseRate(s)
+		if err != nil {
+			t.Errorf("ParseRate(%q) failed: %v", s, err)
+		} else if got != want {
+			t.Errorf("ParseRate(%q) = %d, want %d", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "/s", "fast", "-1MB/s", "20MB/min", "20MB/s/s"} {
+		if got, err := ParseRate(s); err == nil {
+			t.Errorf("ParseRate(%q) = %d, want an error", s, got)
+		}
+	}
+}
+
+func TestRateFlag(t *testing.T) {
+	var r Rate
+	if r.String() != "0" {
+		t.Errorf("zero Rate shows as %q, want no limit", r.String())
+	}
+	if err := r.Set("20MB/s"); err != nil || r != 20000000 {
+		t.Errorf("Set(%q) = %v, rate is %d", "20MB/s", err, r)
+	}
+	if err := r.Set("fast"); err == nil {
+		t.Error("Set() accepted an invalid rate")
+	}
+	if r != 20000000 {
+		t.Errorf("invalid rate changed the rate to %d", r)
+	}
+	if r.String() != "20.0MB/s" {
+		t.Errorf("String() = %q, want %q", r.String(), "20.0MB/s")
+	}
+}
+
+func TestNoLimit(t *testing.T) {
+	for _, rate := range []int64{0, -1} {
+		if l := New(rate); l != nil {
+			t.Errorf("New(%d) = %+v, want no limiter", rate, l)
+		}
+	}
+	var buf bytes.Buffer
+	if w := NewWriter(&buf, nil, New(0)); w != io.Writer(&buf) {
+		t.Error("writer without limiters isn't the underlying writer")
+	}
+	if r := NewReader(&buf, nil); r != io.Reader(&buf) {
+		t.Error("reader without limiters isn't the underlying reader")
+	}
+	New(0).Wait(1 << 30) // doesn't block
+}
+
+// Runs fn, failing unless it takes about want
+func expectDuration(t *testing.T, name string, want time.Duration, fn func()) {
+	t.Helper()
+	start := time.Now()
+	fn()
+	took := time.Since(start)
+	if took < want*8/10 || took > want*3/2+100*time.Millisecond {
+		t.Errorf("%s took %s, want about %s", name, took, want)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	const rate = 1000000
+	data := make([]byte, 250000)
+
+	// Burst of a tenth of a second goes through right away,
+	// the rest at rate
+	want := time.Duration(len(data)-rate/10) * time.Second / rate
+	expectDuration(t, "writing", want, func() {
+		w := NewWriter(io.Discard, New(rate))
+		if n, err := w.Write(data); n != len(data) || err != nil {
+			t.Errorf("Write() = %d, %v", n, err)
+		}
+	})
+	expectDuration(t, "reading", want, func() {
+		r := NewReader(bytes.NewReader(data), New(rate))
+		if n, err := io.Copy(io.Discard, r); n != int64(len(data)) || err != nil {
+			t.Errorf("reading = %d, %v", n, err)
+		}
+	})
+
+	// Slowest of several limiters wins
+	expectDuration(t, "writing with two limiters", want, func() {
+		NewWriter(io.Discard, New(10*rate), New(rate)).Write(data)
+	})
+
+	// Shared limiter keeps everyone together under its rate
+	shared := New(rate)
+	want = time.Duration(2*len(data)-rate/10) * time.Second / rate
+	expectDuration(t, "writing twice on a shared limiter", want, func() {
+		var wg sync.WaitGroup
+		for range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				NewWriter(io.Discard, shared).Write(data)
+			}()
+		}
+		wg.Wait()
+	})
+}
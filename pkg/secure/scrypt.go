@@ -0,0 +1,141 @@
+package secure
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// Cost of deriving keys of stored uploads, so that each guess of the secret
+// takes about 32MiB of memory and a good fraction of a second
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Derives a keyLen bytes long key from password and salt with scrypt, as
+// specified in RFC 7914. N is the CPU and memory cost, a power of two
+// over 1, r the block size and p the parallelization.
+func scrypt(password, salt []byte, N, r, p, keyLen int) ([]byte, error) {
+	if N <= 1 || N&(N-1) != 0 {
+		return nil, errors.New("scrypt: N must be a power of two over 1")
+	}
+	if r <= 0 || p <= 0 || uint64(r)*uint64(p) >= 1<<30 || r > 1<<24/N || r > 1<<24/p {
+		return nil, errors.New("scrypt: parameters are too large")
+	}
+	b := pbkdf2(password, salt, 1, p*128*r)
+	x := make([]uint32, 32*r)
+	v := make([]uint32, 32*r*N)
+	for i := range p {
+		roMix(b[i*128*r:(i+1)*128*r], r, N, x, v)
+	}
+	return pbkdf2(password, b, 1, keyLen), nil
+}
+
+// PBKDF2 with HMAC-SHA256, as specified in RFC 8018
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLen+sha256.Size)
+	u := make([]byte, sha256.Size)
+	t := make([]byte, sha256.Size)
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for range iterations - 1 {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// Mixes block b of 128*r bytes in place, using x and v as scratch space
+func roMix(b []byte, r, N int, x, v []uint32) {
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	y := make([]uint32, len(x))
+	for i := range N {
+		copy(v[i*len(x):], x)
+		blockMix(x, y, r)
+	}
+	for range N {
+		j := int(x[(2*r-1)*16] & uint32(N-1))
+		for k := range x {
+			x[k] ^= v[j*len(x)+k]
+		}
+		blockMix(x, y, r)
+	}
+	for i, w := range x {
+		binary.LittleEndian.PutUint32(b[i*4:], w)
+	}
+}
+
+// Runs scrypt's BlockMix on b of 2*r 64 byte blocks, using y as scratch space
+func blockMix(b, y []uint32, r int) {
+	var t [16]uint32
+	copy(t[:], b[(2*r-1)*16:])
+	for i := range 2 * r {
+		for k := range t {
+			t[k] ^= b[i*16+k]
+		}
+		salsa208(&t)
+		// Even blocks go to the first half, odd ones to the second
+		copy(y[(i/2+(i%2)*r)*16:], t[:])
+	}
+	copy(b, y)
+}
+
+// Salsa20/8 core, applied to b in place
+func salsa208(b *[16]uint32) {
+	x := *b
+	for range 4 {
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
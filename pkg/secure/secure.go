@@ -0,0 +1,185 @@
+// Package secure provides an encrypted stream between sender and receiver,
+// keyed by a PAKE run over the share code.
+//
+// The stream is sent as a sequence of [proto.OpcodeEncryptedChunk] frames,
+// each holding at most [MaxChunkSize] bytes of plaintext sealed with
+// AES-256-GCM. Each direction uses its own key and a counter as nonce, so
+// chunks can't be reordered, replayed or reflected back by the relay.
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/diwasrimal/bullet/pkg/pake"
+	"github.com/diwasrimal/bullet/pkg/proto"
+)
+
+// Largest plaintext carried in a single encrypted chunk
+const MaxChunkSize = 32 * 1024
+
+// Returned when peer used a different share code than us
+var ErrKeyMismatch = errors.New("key confirmation failed, share codes don't match")
+
+// Conn is an encrypted stream over an underlying connection
+type Conn struct {
+	rw      io.ReadWriter
+	sealer  cipher.AEAD
+	opener  cipher.AEAD
+	sendSeq uint64
+	recvSeq uint64
+	pending []byte // decrypted data not yet read
+}
+
+// Establish runs the key exchange with peer over rw using the share code
+// as password, and returns the encrypted stream on success.
+func Establish(rw io.ReadWriter, role pake.Role, shareCode string) (*Conn, error) {
+	session, err := pake.New(role, shareCode)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := proto.WriteFrame(rw, proto.OpcodeKeyExchange, session.Message()); err != nil {
+		return nil, err
+	}
+	opcode, payload, err := proto.ReadFrame(rw)
+	if err != nil {
+		return nil, err
+	}
+	if opcode != proto.OpcodeKeyExchange {
+		return nil, fmt.Errorf("unexpected opcode during key exchange, have (%d) want (%d)", opcode, proto.OpcodeKeyExchange)
+	}
+	if err := session.Finish(payload); err != nil {
+		return nil, err
+	}
+
+	// Both sides confirm they derived the same key before using it
+	if _, err := proto.WriteFrame(rw, proto.OpcodeKeyConfirm, session.Confirmation()); err != nil {
+		return nil, err
+	}
+	opcode, payload, err = proto.ReadFrame(rw)
+	if err != nil {
+		return nil, err
+	}
+	if opcode != proto.OpcodeKeyConfirm {
+		return nil, fmt.Errorf("unexpected opcode during key confirmation, have (%d) want (%d)", opcode, proto.OpcodeKeyConfirm)
+	}
+	if !session.VerifyConfirmation(payload) {
+		return nil, ErrKeyMismatch
+	}
+
+	return NewConn(rw, role, session.Key())
+}
+
+// NewConn wraps rw in an encrypted stream using an already agreed key.
+func NewConn(rw io.ReadWriter, role pake.Role, key []byte) (*Conn, error) {
+	senderAEAD, err := newAEAD(key, "sender to receiver")
+	if err != nil {
+		return nil, err
+	}
+	receiverAEAD, err := newAEAD(key, "receiver to sender")
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{rw: rw, sealer: senderAEAD, opener: receiverAEAD}
+	if role == pake.RoleReceiver {
+		c.sealer, c.opener = receiverAEAD, senderAEAD
+	}
+	return c, nil
+}
+
+// Write encrypts p and writes it as one or more chunks.
+func (c *Conn) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p[:min(len(p), MaxChunkSize)]
+		sealed := c.sealer.Seal(nil, nonce(c.sendSeq), chunk, nil)
+		if _, err := proto.WriteFrame(c.rw, proto.OpcodeEncryptedChunk, sealed); err != nil {
+			return n, err
+		}
+		c.sendSeq++
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// Read reads decrypted data, reading the next chunk from the underlying
+// connection if nothing is buffered.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	if len(c.pending) == 0 {
+		opcode, payload, err := proto.ReadFrame(c.rw)
+		if err != nil {
+			return 0, err
+		}
+		if opcode == proto.OpcodeCancel {
+			return 0, proto.ErrCancelled
+		}
+		if opcode == proto.OpcodeError {
+			// Only the relay sends these, like when it can't give us a stored upload
+			relayErr, err := proto.ParseJSON[proto.ErrorPayload](payload)
+			if err != nil {
+				return 0, fmt.Errorf("malformed error frame: %w", err)
+			}
+			return 0, &relayErr
+		}
+		if opcode != proto.OpcodeEncryptedChunk {
+			return 0, fmt.Errorf("unexpected opcode in encrypted stream (%d)", opcode)
+		}
+		plain, err := c.opener.Open(payload[:0], nonce(c.recvSeq), payload, nil)
+		if err != nil {
+			return 0, fmt.Errorf("decrypting chunk %d: %w", c.recvSeq, err)
+		}
+		c.recvSeq++
+		c.pending = plain
+	}
+	n = copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// StoredKeys derives keys of an upload kept by the relay for a receiver to
+// fetch later, since there's no peer to run the key exchange with. They're
+// keyed by the secret part of the share code, as the relay may only pick
+// the channel once the upload starts, and salt which must be random for
+// each upload. key encrypts the upload, and access is what a receiver shows
+// the relay to get it. The relay only keeps SHA-256 of access, so it can't
+// hand the upload to anyone on its own.
+//
+// Unlike keys from Establish, whoever holds the upload can try secrets
+// against it offline. Keys are derived with scrypt to make each try costly,
+// but the secret must still be long and random enough to make that
+// impractical.
+func StoredKeys(secret string, salt []byte) (key, access []byte, err error) {
+	master, err := scrypt([]byte(secret), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	return subkey(master, "stored upload key"), subkey(master, "stored upload access"), nil
+}
+
+func subkey(master []byte, label string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte, label string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(seq uint64) []byte {
+	var buf [12]byte
+	binary.BigEndian.PutUint64(buf[4:], seq)
+	return buf[:]
+}
@@ -0,0 +1,198 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/diwasrimal/bullet/pkg/pake"
+	"github.com/diwasrimal/bullet/pkg/proto"
+)
+
+// Encrypts data as the sender would, returning the chunks it wrote
+func seal(t *testing.T, key, data []byte) [][]byte {
+	t.Helper()
+	var buf bytes.Buffer
+	c, err := NewConn(&buf, pake.RoleSender, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for buf.Len() > 0 {
+		opcode, payload, err := proto.ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != proto.OpcodeEncryptedChunk {
+			t.Fatalf("unexpected opcode %s", opcode)
+		}
+		chunks = append(chunks, payload)
+	}
+	return chunks
+}
+
+// Decrypts chunks as the receiver would
+func open(t *testing.T, key []byte, chunks [][]byte) ([]byte, error) {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, chunk := range chunks {
+		proto.WriteFrame(&buf, proto.OpcodeEncryptedChunk, chunk)
+	}
+	return io.ReadAll(reader(t, &buf, pake.RoleReceiver, key))
+}
+
+// Encrypted stream that reads from r as role
+func reader(t *testing.T, r io.Reader, role pake.Role, key []byte) *Conn {
+	t.Helper()
+	c, err := NewConn(struct {
+		io.Reader
+		io.Writer
+	}{r, io.Discard}, role, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testKeyAndData(t *testing.T) (key, data []byte) {
+	key = make([]byte, 32)
+	data = make([]byte, 2*MaxChunkSize+100)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return key, data
+}
+
+func TestRoundTrip(t *testing.T) {
+	key, data := testKeyAndData(t)
+	chunks := seal(t, key, data)
+	if len(chunks) != 3 {
+		t.Fatalf("have %d chunks, want 3", len(chunks))
+	}
+	got, err := open(t, key, chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("decrypted data differs from what was sent")
+	}
+}
+
+func TestTampered(t *testing.T) {
+	key, data := testKeyAndData(t)
+	for name, tamper := range map[string]func(chunks [][]byte) [][]byte{
+		"flipped bit": func(chunks [][]byte) [][]byte {
+			chunks[1][10] ^= 1
+			return chunks
+		},
+		"reordered": func(chunks [][]byte) [][]byte {
+			chunks[0], chunks[1] = chunks[1], chunks[0]
+			return chunks
+		},
+		"replayed": func(chunks [][]byte) [][]byte {
+			return append(chunks[:2:2], chunks[1])
+		},
+		"dropped": func(chunks [][]byte) [][]byte {
+			return chunks[1:]
+		},
+	} {
+		if _, err := open(t, key, tamper(seal(t, key, data))); err == nil {
+			t.Errorf("%s chunk was accepted", name)
+		}
+	}
+
+	// Chunks can't be reflected back to their sender either
+	chunks := seal(t, key, data)
+	var buf bytes.Buffer
+	proto.WriteFrame(&buf, proto.OpcodeEncryptedChunk, chunks[0])
+	if _, err := io.ReadAll(reader(t, &buf, pake.RoleSender, key)); err == nil {
+		t.Error("reflected chunk was accepted")
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	key, data := testKeyAndData(t)
+	chunks := seal(t, key, data)
+	last := len(chunks) - 1
+
+	// Cut inside a chunk's frame, so it can't be read whole
+	var buf bytes.Buffer
+	for _, chunk := range chunks {
+		proto.WriteFrame(&buf, proto.OpcodeEncryptedChunk, chunk)
+	}
+	buf.Truncate(buf.Len() - 5)
+	if _, err := io.ReadAll(reader(t, &buf, pake.RoleReceiver, key)); err != io.ErrUnexpectedEOF {
+		t.Errorf("cut frame: have %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// Cut ciphertext of a chunk, with the frame adjusted to match
+	chunks[last] = chunks[last][:len(chunks[last])-1]
+	if _, err := open(t, key, chunks); err == nil {
+		t.Error("cut chunk was accepted")
+	}
+}
+
+func TestScrypt(t *testing.T) {
+	salt := make([]byte, 16)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	// Vectors of RFC 7914, and one with the parameters of stored uploads
+	for _, c := range []struct {
+		password, salt string
+		N, r, p        int
+		want           string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+		{"20-char-secret-xyzab", string(salt), scryptN, scryptR, scryptP, "595ddd5afed65857552b650afa972b0104b6d15e2e116d07fd4ffafd2b99bfeb"},
+	} {
+		key, err := scrypt([]byte(c.password), []byte(c.salt), c.N, c.r, c.p, len(c.want)/2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(key); got != c.want {
+			t.Errorf("scrypt(%q, N=%d, r=%d, p=%d) = %s, want %s", c.password, c.N, c.r, c.p, got, c.want)
+		}
+	}
+
+	for _, N := range []int{0, 1, 3, 1000} {
+		if _, err := scrypt(nil, nil, N, 1, 1, 32); err == nil {
+			t.Errorf("scrypt() accepted N=%d", N)
+		}
+	}
+
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got := hex.EncodeToString(pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)); got != want {
+		t.Errorf("pbkdf2() = %s, want %s", got, want)
+	}
+}
+
+func TestStoredKeys(t *testing.T) {
+	salt := make([]byte, 16)
+	key, access, err := StoredKeys("k3vq7mzxw2ahdf5tnr9c", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(key, access) {
+		t.Error("upload key is what's shown to the relay")
+	}
+	again, _, _ := StoredKeys("k3vq7mzxw2ahdf5tnr9c", salt)
+	if !bytes.Equal(key, again) {
+		t.Error("same secret and salt derived different keys")
+	}
+	other, _, _ := StoredKeys("k3vq7mzxw2ahdf5tnr9d", salt)
+	salt[0] = 1
+	salted, _, _ := StoredKeys("k3vq7mzxw2ahdf5tnr9c", salt)
+	if bytes.Equal(key, other) || bytes.Equal(key, salted) {
+		t.Error("different secret or salt derived the same key")
+	}
+}
@@ -1,14 +1,26 @@
 package utils
 
-import "math/rand"
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
 
-func RandCode() string {
+// Returns random characters for the secret part of a share code, drawn
+// from crypto/rand since the secret keys the transfer
+func RandCode() (string, error) {
 	const randchars = "1234567890qwertyuiopasdfghjklzxcvbnmQWERTYUIOPASDFGHJKLZXCVBNM"
 	buf := make([]byte, 8)
 	for i := range len(buf) {
-		buf[i] = randchars[rand.Intn(len(randchars))]
+		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(randchars))))
+		if err != nil {
+			return "", err
+		}
+		buf[i] = randchars[idx.Int64()]
 	}
-	return string(buf)
+	return string(buf), nil
 }
 
 func Assert(condition bool, msg string) {
@@ -16,3 +28,52 @@ func Assert(condition bool, msg string) {
 		panic(msg)
 	}
 }
+
+// Formats a byte count in SI units, like 104.9MB
+func ReadableSize(b int64) string {
+	const unit = 1000
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(b)/float64(div), "kMGTPE"[exp])
+}
+
+var sizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1e3,
+	"kb":  1e3,
+	"m":   1e6,
+	"mb":  1e6,
+	"g":   1e9,
+	"gb":  1e9,
+	"t":   1e12,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// Parses a byte count like 20MB, 512k or 1.5GiB, in SI units unless
+// they're binary ones like MiB, the inverse of ReadableSize
+func ParseSize(s string) (int64, error) {
+	size := strings.ToLower(strings.TrimSpace(s))
+	i := strings.IndexFunc(size, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(size)
+	}
+	n, err := strconv.ParseFloat(size[:i], 64)
+	unit, known := sizeUnits[strings.TrimSpace(size[i:])]
+	if err != nil || !known || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, want something like 20MB", s)
+	}
+	return int64(n * unit), nil
+}
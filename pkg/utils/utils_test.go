@@ -0,0 +1,44 @@
+package utils
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{
+		"0":        0,
+		"512":      512,
+		"512b":     512,
+		"512k":     512000,
+		"20MB":     20000000,
+		"20 mb":    20000000,
+		" 1.5GiB ": 1610612736,
+		"1KiB":     1024,
+		"2tb":      2000000000000,
+		"10M":      10000000,
+	} {
+		got, err := ParseSize(s)
+		if err != nil {
+			t.Errorf("ParseSize(%q) failed: %v", s, err)
+		} else if got != want {
+			t.Errorf("ParseSize(%q) = %d, want %d", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "MB", "-1MB", "20XB", "1.2.3k", "twenty", "20MB/s"} {
+		if got, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) = %d, want an error", s, got)
+		}
+	}
+}
+
+func TestReadableSizeParses(t *testing.T) {
+	for _, b := range []int64{0, 999, 1000, 104857600, 4294967296} {
+		size, err := ParseSize(ReadableSize(b))
+		if err != nil {
+			t.Errorf("ParseSize(ReadableSize(%d)) failed: %v", b, err)
+			continue
+		}
+		// ReadableSize rounds to one decimal place
+		if diff := size - b; diff < -b/100 || diff > b/100 {
+			t.Errorf("ParseSize(%q) = %d, want about %d", ReadableSize(b), size, b)
+		}
+	}
+}
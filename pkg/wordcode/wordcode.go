@@ -0,0 +1,144 @@
+// Package wordcode generates share code secrets made of words, like
+// crystal-pigeon-harbor, which are easier to read out loud and type than
+// random characters.
+//
+// The wordlist has 1024 words, so each word adds 10 bits of entropy. No
+// two words are less than 3 edits apart, so a word with a typo is still
+// closer to the word that was meant than to any other.
+package wordcode
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"math/big"
+	"strings"
+)
+
+//go:embed words.txt
+var wordlist string
+
+var (
+	words   = strings.Fields(wordlist)
+	wordSet = make(map[string]bool, len(words))
+)
+
+func init() {
+	for _, w := range words {
+		wordSet[w] = true
+	}
+}
+
+// Edits a mistyped word can be off by, and still be corrected. Kept low
+// so that words of custom share codes are rarely mistaken for typos.
+const maxTypos = 1
+
+// Generate returns n random words joined with dashes
+func Generate(n int) (string, error) {
+	picked := make([]string, n)
+	for i := range picked {
+		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+		if err != nil {
+			return "", err
+		}
+		picked[i] = words[idx.Int64()]
+	}
+	return strings.Join(picked, "-"), nil
+}
+
+// IsWord reports whether w is in the wordlist
+func IsWord(w string) bool {
+	return wordSet[w]
+}
+
+// Suggest returns the share code that was likely meant by code, if it looks
+// like a mistyped word code: words not in the wordlist are replaced with the
+// closest one, and letters mistaken for digits in the channel are fixed.
+// Returns code unchanged if it doesn't look like a word code, or if there's
+// nothing to fix.
+func Suggest(code string) string {
+	parts := strings.Split(code, "-")
+	if len(parts) < 3 {
+		return code
+	}
+	known := 0
+	for _, w := range parts[1:] {
+		if IsWord(w) {
+			known++
+		}
+	}
+	if known == 0 {
+		return code // likely a custom share code
+	}
+	parts[0] = fixDigits(parts[0])
+	for i, w := range parts[1:] {
+		if !IsWord(w) {
+			if closest, ok := closestWord(w); ok {
+				parts[i+1] = closest
+			}
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// Fixes letters that look like digits in a numeric channel, like
+// 1o for 10. Returns channel unchanged if it isn't numeric otherwise.
+func fixDigits(channel string) string {
+	fixed := strings.Map(func(r rune) rune {
+		switch r {
+		case 'o':
+			return '0'
+		case 'l', 'i':
+			return '1'
+		}
+		return r
+	}, channel)
+	for _, r := range fixed {
+		if r < '0' || r > '9' {
+			return channel
+		}
+	}
+	return fixed
+}
+
+// Returns the word closest to w within maxTypos edits,
+// if there's exactly one that close
+func closestWord(w string) (string, bool) {
+	best, bestDist, ties := "", maxTypos+1, 0
+	for _, candidate := range words {
+		d := distance(w, candidate)
+		switch {
+		case d < bestDist:
+			best, bestDist, ties = candidate, d, 0
+		case d == bestDist:
+			ties++
+		}
+	}
+	return best, bestDist <= maxTypos && ties == 0
+}
+
+// Number of insertions, deletions, substitutions and transpositions of
+// adjacent letters needed to turn a into b
+func distance(a, b string) int {
+	// d[i][j] is the distance between a[:i] and b[:j]
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
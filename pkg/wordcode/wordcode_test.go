@@ -0,0 +1,70 @@
+package wordcode
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	for _, n := range []int{1, 3, 6} {
+		code, err := Generate(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked := strings.Split(code, "-")
+		if len(picked) != n {
+			t.Errorf("Generate(%d) = %q, want %d words", n, code, n)
+		}
+		for _, w := range picked {
+			if !IsWord(w) {
+				t.Errorf("Generate(%d) = %q, %q isn't in the wordlist", n, code, w)
+			}
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	for code, want := range map[string]string{
+		// Typos in words and the channel get fixed
+		"20-crystal-pigeon-harbour": "20-crystal-pigeon-harbor",
+		"20-crystl-pigeon-harbor":   "20-crystal-pigeon-harbor",
+		"20-crystal-pigoen-harbor":  "20-crystal-pigeon-harbor",
+		"2o-crystal-pigeon-harbor":  "20-crystal-pigeon-harbor",
+		"l0-crystal-pigeon-harbor":  "10-crystal-pigeon-harbor",
+
+		// Nothing to fix
+		"20-crystal-pigeon-harbor": "20-crystal-pigeon-harbor",
+
+		// Custom share codes, some of their words are in the wordlist
+		// or close to ones that are
+		"4-office-printer-setup": "4-office-printer-setup",
+		"20-df6YOFss":            "20-df6YOFss",
+		"7-my-secret-thing":      "7-my-secret-thing",
+		"go-crystal-xyzzyq":      "go-crystal-xyzzyq",
+
+		// Too far off to tell which word was meant
+		"20-crystal-pgn-harbor": "20-crystal-pgn-harbor",
+	} {
+		if got := Suggest(code); got != want {
+			t.Errorf("Suggest(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestFixDigits(t *testing.T) {
+	for channel, want := range map[string]string{
+		"20":  "20",
+		"2o":  "20",
+		"1o":  "10",
+		"l0":  "10",
+		"i7":  "17",
+		"oil": "011",
+		"go":  "go",
+		"abc": "abc",
+		"":    "",
+	} {
+		if got := fixDigits(channel); got != want {
+			t.Errorf("fixDigits(%q) = %q, want %q", channel, got, want)
+		}
+	}
+}